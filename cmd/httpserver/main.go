@@ -1,24 +1,32 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/h0dy/tcp-to-http/internal/headers"
+	"github.com/h0dy/tcp-to-http/internal/middleware"
 	"github.com/h0dy/tcp-to-http/internal/request"
 	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/h0dy/tcp-to-http/internal/router"
 	"github.com/h0dy/tcp-to-http/internal/server"
 	"github.com/joho/godotenv"
 )
 
+// shutdownTimeout bounds how long in-flight responses get on shutdown
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	// Load .env file
 	err := godotenv.Load()
@@ -26,46 +34,78 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	// SOCKET serves on a Unix socket (e.g. behind nginx) instead of PORT
+	socket := os.Getenv("SOCKET")
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
-	if port == 0 {
+	if port == 0 && socket == "" {
 		log.Fatalln("please make sure to setup PORT env")
 	}
+	// HOST is optional, e.g. 127.0.0.1 to only accept local connections
+	host := os.Getenv("HOST")
 
-	// server.Serve starts an HTTP server
-	server, err := server.Serve(port, handler)
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
-	}
-	defer server.Close()
+	r := router.New()
+	r.Get("/client-error", handler400)
+	r.Get("/internal-error", handler500)
+	r.Get("/video", videoHandler)
+	r.Get("/home", homeHandler)
+	r.Mount("/httpbin", proxyHandler)
+	// every other path gets the default page
+	r.NotFound = handler200
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
-}
+	logger := log.Default()
+	handler := server.Chain(r.Handler(),
+		middleware.Recover(logger),
+		middleware.RequestID(),
+		middleware.Logging(logger),
+		middleware.Timing(),
+	)
 
-// handler routes the request to the appropriate response
-func handler(w *response.Writer, req *request.Request) {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		proxyHandler(w, req)
+	cfg := server.DefaultConfig()
+	cfg.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	if socket != "" {
+		cfg.Addr = "unix:" + socket
+		// let the proxy's group connect
+		cfg.SocketMode = 0o660
 	}
+	cfg.Handler = handler
+	cfg.Logger = logger
+	// serve HTTPS when both CERT_FILE and KEY_FILE are set
+	cfg.CertFile = os.Getenv("CERT_FILE")
+	cfg.KeyFile = os.Getenv("KEY_FILE")
+	srv := server.New(cfg)
 
-	switch req.RequestLine.RequestTarget {
-	case "/client-error":
-		handler400(w, req)
+	// srv.ListenAndServe blocks until the server stops
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
 
-	case "/internal-error":
-		handler500(w, req)
-
-	case "/video":
-		videoHandler(w, req)
-
-	case "/home":
-		homeHandler(w, req)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig != syscall.SIGHUP {
+				break wait
+			}
+			// SIGHUP reloads the certificate files
+			if err := srv.ReloadCertificates(); err != nil {
+				log.Printf("Error reloading certificates: %v", err)
+			}
+		case err := <-serveErr:
+			log.Printf("Server stopped: %v", err)
+			break wait
+		}
+	}
 
-	default:
-		handler200(w, req)
+	// let in-flight responses finish before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error during shutdown: %v", err)
 	}
+	log.Println("Server gracefully stopped")
 }
 
 func homeHandler(w *response.Writer, _ *request.Request) {
@@ -81,7 +121,7 @@ func homeHandler(w *response.Writer, _ *request.Request) {
 </html>
 `)
 	h := response.GetDefaultHeaders(len(body))
-	h.Update("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
 	w.WriteBody(body)
 }
@@ -99,7 +139,7 @@ func handler400(w *response.Writer, _ *request.Request) {
 </html>
 `)
 	h := response.GetDefaultHeaders(len(body))
-	h.Update("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
 	w.WriteBody(body)
 }
@@ -117,7 +157,7 @@ func handler500(w *response.Writer, _ *request.Request) {
 </html>
 `)
 	h := response.GetDefaultHeaders(len(body))
-	h.Update("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
 	w.WriteBody(body)
 }
@@ -135,7 +175,7 @@ func handler200(w *response.Writer, _ *request.Request) {
 </html>
 `)
 	h := response.GetDefaultHeaders(len(body))
-	h.Update("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
 	w.WriteBody(body)
 }
@@ -143,12 +183,24 @@ func handler200(w *response.Writer, _ *request.Request) {
 // proxyHandler forwards the incoming request to httpbin.org and streams
 // the response back to the client using HTTP chunked transfer encoding
 func proxyHandler(w *response.Writer, req *request.Request) {
-	// Remove the "/httpbin/" prefix to get  the target path
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	fullUrl := "https://httpbin.org/" + target
+	// the router leaves the path after "/httpbin/" in the "*" param
+	upstream := url.URL{
+		Scheme:   "https",
+		Host:     "httpbin.org",
+		Path:     "/" + req.PathParam("*"),
+		RawQuery: req.Target.RawQuery,
+	}
+	fullUrl := upstream.String()
 	fmt.Println("Proxying to", fullUrl)
 
-	resp, err := http.Get(fullUrl)
+	// the upstream call is cancelled with the request, e.g. when the client
+	// goes away or the server shuts down
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, fullUrl, nil)
+	if err != nil {
+		handler500(w, req)
+		return
+	}
+	resp, err := http.DefaultClient.Do(upstreamReq)
 	if err != nil {
 		handler500(w, req)
 		return
@@ -157,9 +209,9 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 
 	w.WriteStatusLine(response.Successful)
 	h := response.GetDefaultHeaders(0)
-	h.Update("Transfer-Encoding", "chunked")
-	h.Update("Trailer", "X-Content-SHA256, X-Content-Length")
-	h.Remove("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+	h.Del("Content-Length")
 	w.WriteHeaders(h)
 
 	fullBody := make([]byte, 0)
@@ -200,8 +252,8 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 
 	// compute SHA-256 hash of the full response body
 	sha256 := fmt.Sprintf("%x", sha256.Sum256(fullBody))
-	trailers.Update("X-Content-SHA256", sha256)
-	trailers.Update("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
+	trailers.Set("X-Content-SHA256", sha256)
+	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
 
 	// write the trailer to the client
 	err = w.WriteTrailers(trailers)
@@ -213,7 +265,6 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 
 // videoHandler streams a video from assets folder
 func videoHandler(w *response.Writer, _ *request.Request) {
-	w.WriteStatusLine(response.Successful)
 	filePath := os.Getenv("VIDEO_PATH")
 	if filePath == "" {
 		log.Fatalln("please make sure to setup VIDEO_PATH env")
@@ -224,8 +275,9 @@ func videoHandler(w *response.Writer, _ *request.Request) {
 		return
 	}
 
+	w.WriteStatusLine(response.Successful)
 	h := response.GetDefaultHeaders(len(videoBytes))
-	h.Update("Content-Type", "video/mp4")
+	h.Set("Content-Type", "video/mp4")
 	w.WriteHeaders(h)
 	w.WriteBody(videoBytes)
 }
@@ -47,7 +47,7 @@ func main() {
 		fmt.Printf("- Version: %s\n", req.RequestLine.HttpVersion)
 
 		fmt.Println("Headers:")
-		for h, v := range req.Headers {
+		for h, v := range req.Headers.All() {
 			fmt.Printf("- %s: %s\n", h, v)
 		}
 	}
@@ -2,16 +2,75 @@ package headers
 
 import (
 	"bytes"
-	"fmt"
+	"errors"
+	"iter"
+	"strconv"
 	"strings"
 )
 
-type Headers map[string]string
+// Field is a single header field line, Name keeps the casing it was
+// received or added with
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers holds header fields in the order they were received or added.
+// Names are matched case-insensitively and repeated fields are kept apart,
+// so values containing commas (like Set-Cookie) are never mixed up. The
+// zero value is empty and ready to use
+type Headers struct {
+	fields []field
+}
+
+// field is a Field along with the Key its name is matched by
+type field struct {
+	Field
+	key Key
+}
 
 const crlf = "\r\n"
 
-// n = the number of bytes consumed
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// NewHeaders returns empty Headers
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+// FoldMode says what to do with obsolete line folding (obs-fold), a field
+// line starting with whitespace that continues the previous field value
+type FoldMode int
+
+const (
+	RejectObsFold FoldMode = iota // fail on a folded line, the default (RFC 9112 section 5.2)
+	UnfoldObsFold                 // replace the fold with a space, joining the line to the previous value
+)
+
+// ErrInvalidField is wrapped by the FieldError Parse returns for a
+// malformed field line
+var ErrInvalidField = errors.New("error: invalid header field")
+
+// FieldError describes why Parse rejected a field line
+type FieldError struct {
+	Offset int // offset of the offending byte in the data given to Parse
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return ErrInvalidField.Error() + ": " + e.Reason
+}
+
+func (e *FieldError) Unwrap() error {
+	return ErrInvalidField
+}
+
+// Parse parses one field line from data, rejecting obsolete line folding.
+// n = the number of bytes consumed, errors are *FieldError
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.ParseWithFolding(data, RejectObsFold)
+}
+
+// ParseWithFolding is Parse with fold choosing how obs-fold is handled
+func (h *Headers) ParseWithFolding(data []byte, fold FoldMode) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
 		return 0, false, nil
@@ -21,27 +80,43 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		// consume the CRLF
 		return 2, true, nil
 	}
-	headersSlice := bytes.SplitN(data[:idx], []byte(":"), 2)
-	header, value, err := parseAndValidateHeader(headersSlice)
+	line := data[:idx]
+
+	if line[0] == ' ' || line[0] == '\t' {
+		if fold == RejectObsFold || len(h.fields) == 0 {
+			return 0, false, &FieldError{Offset: 0, Reason: "obsolete line folding"}
+		}
+		value, err := parseFieldValue(line, 0)
+		if err != nil {
+			return 0, false, err
+		}
+		last := &h.fields[len(h.fields)-1]
+		last.Value = strings.TrimRight(last.Value+" "+value, " ")
+		return idx + 2, false, nil
+	}
+
+	colon := bytes.IndexByte(line, ':')
+	if colon == -1 {
+		return 0, false, &FieldError{Offset: idx, Reason: "missing colon"}
+	}
+	header, value, err := parseAndValidateHeader(line, colon)
 	if err != nil {
-		return 0, false, fmt.Errorf("poorly formatted header: %s", err.Error())
+		return 0, false, err
 	}
-	h.Set(header, value)
+	h.Add(header, value)
 	return idx + 2, false, nil
 }
 
-func parseAndValidateHeader(line [][]byte) (string, string, error) {
-	header := line[0]
-	if bytes.HasSuffix(header, []byte(" ")) {
-		return "", "", fmt.Errorf("poorly formatted headers: %s", header)
-	}
+// parseAndValidateHeader checks the name (a token, with nothing between it
+// and the colon) and the value of a field line
+func parseAndValidateHeader(line []byte, colon int) (string, string, error) {
+	header := line[:colon]
 	if len(header) < 1 {
-		return "", "", fmt.Errorf("the length of the header must be at least 1: %s", header)
+		return "", "", &FieldError{Offset: 0, Reason: "empty field name"}
 	}
-
-	parsedHeader := strings.TrimSpace(string(header))
-	// Validate each character/token against RFC token rules
-	for _, c := range parsedHeader {
+	// Validate each character/token against RFC token rules, this also
+	// rejects whitespace before the colon
+	for i, c := range header {
 		switch {
 		case c >= 'a' && c <= 'z':
 		case c >= 'A' && c <= 'Z':
@@ -50,39 +125,147 @@ func parseAndValidateHeader(line [][]byte) (string, string, error) {
 			c == '&' || c == '\'' || c == '*' || c == '+' ||
 			c == '-' || c == '.' || c == '^' || c == '_' ||
 			c == '`' || c == '|' || c == '~':
+		case c == ' ' || c == '\t':
+			return "", "", &FieldError{Offset: i, Reason: "whitespace before the colon"}
 		default:
-			return "", "", fmt.Errorf("invalid header: %s", header)
+			return "", "", &FieldError{Offset: i, Reason: "invalid character " + strconv.QuoteRune(rune(c)) + " in field name"}
+		}
+	}
+	value, err := parseFieldValue(line[colon+1:], colon+1)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(header), value, nil
+}
+
+// parseFieldValue trims the optional whitespace around a field value and
+// checks it only holds VCHAR, obs-text, SP and HTAB (RFC 9110 section 5.5).
+// offset is where raw starts in the line, for errors
+func parseFieldValue(raw []byte, offset int) (string, error) {
+	for i, c := range raw {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return "", &FieldError{Offset: offset + i, Reason: "invalid character " + strconv.QuoteRune(rune(c)) + " in field value"}
 		}
 	}
-	value := strings.TrimSpace(string(line[1]))
+	return string(bytes.Trim(raw, " \t")), nil
+}
+
+// Add appends a field, keeping any existing ones with the same name
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, newField(key, value))
+}
+
+func newField(name, value string) field {
+	return field{Field: Field{Name: name, Value: value}, key: CanonicalKey(name)}
+}
+
+// Set replaces every field named key with a single one, which takes the
+// place of the first of them (or goes last if there was none)
+func (h *Headers) Set(key, value string) {
+	i := h.index(key)
+	if i == -1 {
+		h.Add(key, value)
+		return
+	}
+	h.fields[i] = newField(key, value)
+	h.fields = append(h.fields[:i+1], deleteFields(h.fields[i+1:], h.fields[i].key)...)
+}
 
-	return strings.ToLower(parsedHeader), value, nil
+// Get returns the value of the first field named key
+func (h *Headers) Get(key string) (string, bool) {
+	i := h.index(key)
+	if i == -1 {
+		return "", false
+	}
+	return h.fields[i].Value, true
 }
 
-func (h Headers) Set(key, value string) {
-	key = strings.ToLower(key)
-	if old, ok := h[key]; ok {
-		value = old + ", " + value
-		h[key] = value
+// Values returns the values of every field named key, in order
+func (h *Headers) Values(key string) []string {
+	k := CanonicalKey(key)
+	var values []string
+	for _, f := range h.fields {
+		if f.key == k {
+			values = append(values, f.Value)
+		}
 	}
-	h[key] = value
+	return values
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	val, ok := h[key]
-	return val, ok
+// Del removes every field named key
+func (h *Headers) Del(key string) {
+	h.fields = deleteFields(h.fields, CanonicalKey(key))
 }
 
-func (h Headers) Update(key, value string) {
-	key = strings.ToLower(key)
-	h[key] = value
+// Len returns the number of fields
+func (h *Headers) Len() int {
+	return len(h.fields)
 }
 
-func NewHeaders() Headers {
-	return Headers{}
+// All iterates over the fields in order, with the names as they were added
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, f := range h.fields {
+			if !yield(f.Name, f.Value) {
+				return
+			}
+		}
+	}
 }
 
-func (h Headers) Remove(key string) {
-	key = strings.ToLower(key)
-	delete(h, key)
+// Clone returns a copy of h that can be changed independently
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: append([]field(nil), h.fields...)}
+}
+
+// Map returns a map view of h for code that predates Headers keeping field
+// lines apart: names are lowercase and repeated fields are comma-joined.
+// Changing the map doesn't change h
+func (h *Headers) Map() map[string]string {
+	m := make(map[string]string, len(h.fields))
+	for _, f := range h.fields {
+		key := strings.ToLower(f.Name)
+		if old, ok := m[key]; ok {
+			m[key] = old + ", " + f.Value
+			continue
+		}
+		m[key] = f.Value
+	}
+	return m
+}
+
+// HasToken reports whether the comma-separated lists in the fields named
+// key contain token (compared case-insensitively), e.g. "close" in Connection
+func (h *Headers) HasToken(key, token string) bool {
+	for _, val := range h.Values(key) {
+		for part := range strings.SplitSeq(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// index returns the position of the first field named key, or -1
+func (h *Headers) index(key string) int {
+	k := CanonicalKey(key)
+	for i, f := range h.fields {
+		if f.key == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// deleteFields removes the fields matching key from fields, in place
+func deleteFields(fields []field, key Key) []field {
+	out := fields[:0]
+	for _, f := range fields {
+		if f.key != key {
+			out = append(out, f)
+		}
+	}
+	return out
 }
@@ -2,11 +2,18 @@ package headers
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// get returns the first value of key, or "" if there is none
+func get(h *Headers, key string) string {
+	val, _ := h.Get(key)
+	return val
+}
+
 func TestNewHeader(t *testing.T) {
 	// Test: Valid single header
 	headers := NewHeaders()
@@ -14,8 +21,8 @@ func TestNewHeader(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:8080", headers["host"])
-	assert.Equal(t, 23, n)
+	assert.Equal(t, "localhost:8080", get(headers, "host"))
+	assert.Equal(t, 22, n)
 	assert.False(t, done)
 
 	// Test: Invalid spacing header
@@ -28,22 +35,23 @@ func TestNewHeader(t *testing.T) {
 
 	// Test: Valid single header with extra whitespace
 	headers = NewHeaders()
-	data = []byte("       Host: localhost:8080                           \r\n\r\n")
+	data = []byte("Host:        localhost:8080                           \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:8080", headers["host"])
-	assert.Equal(t, 57, n)
+	assert.Equal(t, "localhost:8080", get(headers, "host"))
+	assert.Equal(t, 56, n)
 	assert.False(t, done)
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:8080"}
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:8080")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:8080", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, "localhost:8080", get(headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(headers, "user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -53,7 +61,7 @@ func TestNewHeader(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Empty(t, headers)
+	assert.Zero(t, headers.Len())
 	assert.Equal(t, 2, n)
 	assert.True(t, done)
 
@@ -74,12 +82,229 @@ func TestNewHeader(t *testing.T) {
 	assert.False(t, done)
 
 	// Test: Same header key
-	headers = map[string]string{"set-user": "h0dy"}
+	headers = NewHeaders()
+	headers.Add("Set-User", "h0dy")
 	data = []byte("Set-User: hody\r\n\r\n")
 	_, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "h0dy, hody", headers["set-user"])
+	assert.Equal(t, []string{"h0dy", "hody"}, headers.Values("set-user"))
+	assert.Equal(t, "h0dy, hody", headers.Map()["set-user"])
 	// assert.Equal(t, 25, n)
 	assert.False(t, done)
 }
+
+func TestHeadersMultiValue(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	h.Add("Content-Type", "text/plain")
+	h.Add("set-cookie", "b=2")
+
+	// Test: Repeated fields keep their values apart, in order
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, h.Values("SET-COOKIE"))
+	assert.Equal(t, "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", get(h, "Set-Cookie"))
+	assert.Nil(t, h.Values("X-Missing"))
+
+	// Test: Iteration keeps the order and casing of the fields
+	var lines []string
+	for name, value := range h.All() {
+		lines = append(lines, name+": "+value)
+	}
+	assert.Equal(t, []string{
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT",
+		"Content-Type: text/plain",
+		"set-cookie: b=2",
+	}, lines)
+
+	// Test: Set replaces every value in place of the first one
+	h.Set("SET-COOKIE", "c=3")
+	assert.Equal(t, []string{"c=3"}, h.Values("set-cookie"))
+	assert.Equal(t, 2, h.Len())
+	name, _ := firstField(h)
+	assert.Equal(t, "SET-COOKIE", name)
+
+	// Test: Clone is independent
+	clone := h.Clone()
+	clone.Add("X-Clone", "1")
+	clone.Set("Content-Type", "text/html")
+	assert.Equal(t, 2, h.Len())
+	assert.Equal(t, "text/plain", get(h, "content-type"))
+
+	// Test: Del removes every value
+	h.Add("X-Dup", "1")
+	h.Add("X-Dup", "2")
+	h.Del("x-dup")
+	_, ok := h.Get("X-Dup")
+	assert.False(t, ok)
+
+	// Test: Map view joins repeated fields under lowercase names
+	h.Add("Accept", "text/html")
+	h.Add("ACCEPT", "*/*")
+	assert.Equal(t, map[string]string{
+		"set-cookie":   "c=3",
+		"content-type": "text/plain",
+		"accept":       "text/html, */*",
+	}, h.Map())
+
+	// Test: Tokens are found across repeated fields
+	h.Add("Connection", "keep-alive")
+	h.Add("Connection", "Upgrade")
+	assert.True(t, h.HasToken("connection", "upgrade"))
+	assert.False(t, h.HasToken("connection", "close"))
+
+	// Test: The zero value is usable
+	var zero Headers
+	zero.Add("A", "1")
+	assert.Equal(t, "1", get(&zero, "a"))
+}
+
+func TestFieldValidation(t *testing.T) {
+	// Test: Whitespace between the name and the colon is rejected
+	for _, line := range []string{"Host : x\r\n", "Host\t: x\r\n", " Host: x\r\n"} {
+		h := NewHeaders()
+		n, _, err := h.Parse([]byte(line))
+		require.Error(t, err, line)
+		assert.Equal(t, 0, n)
+	}
+
+	// Test: Control characters in values are rejected
+	for _, line := range []string{"A: b\x00c\r\n", "A: b\rc\r\n", "A: b\x1bc\r\n", "A: b\x7fc\r\n"} {
+		h := NewHeaders()
+		_, _, err := h.Parse([]byte(line))
+		require.Error(t, err, "%q", line)
+	}
+
+	// Test: Tabs, visible characters and obs-text are allowed in values
+	h := NewHeaders()
+	_, _, err := h.Parse([]byte("A:\tb\tc \xe9~ \t\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "b\tc \xe9~", get(h, "a"))
+
+	// Test: Obsolete line folding is rejected by default
+	h = NewHeaders()
+	h.Add("A", "b")
+	n, _, err := h.Parse([]byte(" c\r\n"))
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	// Test: Obsolete line folding can be unfolded into the previous value
+	h = NewHeaders()
+	data := []byte("A: b\r\n \t c \r\n\tdd\r\nE: f\r\n\r\n")
+	for {
+		n, done, err := h.ParseWithFolding(data, UnfoldObsFold)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, "b c dd", get(h, "a"))
+	assert.Equal(t, "f", get(h, "e"))
+	assert.Equal(t, 2, h.Len())
+
+	// Test: A folded first line has nothing to continue
+	h = NewHeaders()
+	_, _, err = h.ParseWithFolding([]byte(" b\r\n"), UnfoldObsFold)
+	require.Error(t, err)
+
+	// Test: Folded lines are validated too
+	h = NewHeaders()
+	h.Add("A", "b")
+	_, _, err = h.ParseWithFolding([]byte(" c\x00\r\n"), UnfoldObsFold)
+	require.Error(t, err)
+
+	// Test: Errors are a FieldError with the offset of the offending byte
+	for line, offset := range map[string]int{"Host : x\r\n": 4, "A: b\x00\r\n": 4, "H@st: x\r\n": 1, "Host\r\n": 4} {
+		h := NewHeaders()
+		_, _, err := h.Parse([]byte(line))
+		var fieldErr *FieldError
+		require.ErrorAs(t, err, &fieldErr, "%q", line)
+		assert.Equal(t, offset, fieldErr.Offset, "%q", line)
+		assert.ErrorIs(t, err, ErrInvalidField)
+	}
+}
+
+// firstField returns the first field of h
+func firstField(h *Headers) (string, string) {
+	for name, value := range h.All() {
+		return name, value
+	}
+	return "", ""
+}
+
+func TestCanonicalKey(t *testing.T) {
+	// Test: Names are canonicalized whatever their casing
+	assert.Equal(t, Key("Content-Length"), CanonicalKey("content-length"))
+	assert.Equal(t, Key("Content-Length"), CanonicalKey("CONTENT-LENGTH"))
+	assert.Equal(t, Key("Content-Length"), CanonicalKey("Content-Length"))
+	assert.Equal(t, Key("X-Request-Id"), CanonicalKey("x-REQUEST-ID"))
+	assert.Equal(t, Key("Www-Authenticate"), CanonicalKey("WWW-Authenticate"))
+
+	// Test: Every accessor normalizes the same way
+	h := NewHeaders()
+	_, _, err := h.Parse([]byte("content-length: 42\r\n"))
+	require.NoError(t, err)
+	for _, name := range []string{"Content-Length", "content-length", "CONTENT-LENGTH"} {
+		assert.Equal(t, "42", get(h, name), name)
+		assert.Equal(t, []string{"42"}, h.Values(name), name)
+		assert.True(t, h.HasToken(name, "42"), name)
+	}
+	h.Set("CONTENT-length", "7")
+	assert.Equal(t, 1, h.Len())
+	h.Del("Content-LENGTH")
+	assert.Zero(t, h.Len())
+}
+
+func TestTypedAccessors(t *testing.T) {
+	// Test: ContentLength
+	h := NewHeaders()
+	n, err := h.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), n)
+	h.Set("Content-Length", "1024")
+	n, err = h.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), n)
+	h.Add("Content-Length", "1024, 1024")
+	n, err = h.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), n)
+	for _, bad := range []string{"-1", "+5", "abc", "", "1 024", "99999999999999999999", "5, 6"} {
+		h.Set("Content-Length", bad)
+		_, err = h.ContentLength()
+		assert.ErrorIs(t, err, ErrInvalidContentLength, bad)
+	}
+	h.Set("Content-Length", "5")
+	h.Add("Content-Length", "6")
+	_, err = h.ContentLength()
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+	assert.ErrorIs(t, err, ErrConflictingContentLength)
+
+	// Test: ContentType
+	h = NewHeaders()
+	mediatype, params := h.ContentType()
+	assert.Equal(t, "", mediatype)
+	assert.Nil(t, params)
+	h.Set("Content-Type", "Text/HTML; Charset=\"utf-8\"")
+	mediatype, params = h.ContentType()
+	assert.Equal(t, "text/html", mediatype)
+	assert.Equal(t, map[string]string{"charset": "utf-8"}, params)
+	h.Set("Content-Type", "text/html; charset")
+	mediatype, _ = h.ContentType()
+	assert.Equal(t, "", mediatype)
+
+	// Test: Date in the three HTTP-date formats
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	h = NewHeaders()
+	assert.True(t, h.Date().IsZero())
+	for _, date := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+	} {
+		h.Set("Date", date)
+		assert.True(t, want.Equal(h.Date()), date)
+	}
+	h.Set("Date", "yesterday")
+	assert.True(t, h.Date().IsZero())
+}
@@ -0,0 +1,36 @@
+package headers
+
+// Key is a header field name in canonical form, e.g. "Content-Length".
+// Every Headers method normalizes the names it's given to a Key, which is
+// what makes them case-insensitive
+type Key string
+
+// CanonicalKey returns the canonical form of a field name: the first letter
+// and every letter following a hyphen in upper case, the rest in lower case
+func CanonicalKey(name string) Key {
+	upper := true
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if upper && 'a' <= c && c <= 'z' || !upper && 'A' <= c && c <= 'Z' {
+			return Key(canonicalize(name))
+		}
+		upper = c == '-'
+	}
+	// already canonical, no need to copy
+	return Key(name)
+}
+
+func canonicalize(name string) string {
+	b := []byte(name)
+	upper := true
+	for i, c := range b {
+		switch {
+		case upper && 'a' <= c && c <= 'z':
+			b[i] = c - ('a' - 'A')
+		case !upper && 'A' <= c && c <= 'Z':
+			b[i] = c + ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	return string(b)
+}
@@ -0,0 +1,87 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidContentLength is returned by ContentLength for a value that
+	// isn't a decimal number fitting an int64, or for conflicting values
+	ErrInvalidContentLength = errors.New("error: invalid Content-Length")
+	// ErrConflictingContentLength is returned by ContentLength when repeated
+	// values differ, it is also an ErrInvalidContentLength
+	ErrConflictingContentLength = fmt.Errorf("%w: conflicting values", ErrInvalidContentLength)
+)
+
+// dateFormats are the HTTP-date formats, IMF-fixdate first and then the
+// obsolete ones recipients still have to accept (RFC 9110 section 5.6.7)
+var dateFormats = []string{
+	"Mon, 02 Jan 2006 15:04:05 GMT",
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// ContentLength returns the value of Content-Length, or -1 if there is
+// none. Repeated fields (or a list) are accepted as long as they all hold
+// the same number
+func (h *Headers) ContentLength() (int64, error) {
+	values := h.Values("Content-Length")
+	if len(values) == 0 {
+		return -1, nil
+	}
+
+	length := int64(-1)
+	for _, value := range values {
+		for part := range strings.SplitSeq(value, ",") {
+			part = strings.TrimSpace(part)
+			// 1*DIGIT, ParseInt alone would take a sign
+			if part == "" || strings.IndexFunc(part, func(c rune) bool { return c < '0' || c > '9' }) != -1 {
+				return -1, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+			}
+			n, err := strconv.ParseInt(part, 10, 64)
+			if err != nil {
+				return -1, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+			}
+			if length != -1 && n != length {
+				return -1, fmt.Errorf("%w: %d and %d", ErrConflictingContentLength, length, n)
+			}
+			length = n
+		}
+	}
+	return length, nil
+}
+
+// ContentType returns the media type of Content-Type in lower case with its
+// parameters, e.g. "text/html" and {"charset": "utf-8"}. It returns "" and
+// nil if there is no Content-Type or it can't be parsed
+func (h *Headers) ContentType() (mediatype string, params map[string]string) {
+	value, ok := h.Get("Content-Type")
+	if !ok {
+		return "", nil
+	}
+	mediatype, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", nil
+	}
+	return mediatype, params
+}
+
+// Date returns the time in the Date field, or the zero time if there is
+// none or it isn't a valid HTTP-date
+func (h *Headers) Date() time.Time {
+	value, ok := h.Get("Date")
+	if !ok {
+		return time.Time{}
+	}
+	for _, format := range dateFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
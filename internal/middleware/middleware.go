@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/h0dy/tcp-to-http/internal/headers"
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/h0dy/tcp-to-http/internal/server"
+)
+
+// RequestIDHeader carries the request ID on requests and responses
+const RequestIDHeader = "X-Request-Id"
+
+// Logger is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Logging logs the client address, method, target, status, body size and
+// duration of every request
+func Logging(logger Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			client := "-"
+			if req.RemoteAddr != nil {
+				client = req.RemoteAddr.String()
+			}
+			logger.Printf("%s %s %s %d %dB %v",
+				client, req.RequestLine.Method, req.RequestLine.RequestTarget,
+				w.StatusCode(), w.BytesWritten(), time.Since(start))
+		}
+	}
+}
+
+// Recover turns a panicking handler into a 500 response, as long as the
+// handler didn't start writing its own response
+func Recover(logger Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				logger.Printf("panic serving %s %s: %v\n%s",
+					req.RequestLine.Method, req.RequestLine.RequestTarget, v, debug.Stack())
+				if w.Committed() {
+					return
+				}
+				w.WriteStatusLine(response.InternalServerError)
+				body := []byte("500 Internal Server Error\n")
+				w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+				w.WriteBody(body)
+			}()
+			next(w, req)
+		}
+	}
+}
+
+// RequestID makes sure every request carries an X-Request-Id header, keeping
+// the client's one if sent, and echoes it on the response
+func RequestID() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id, ok := req.Headers.Get("x-request-id")
+			if !ok || id == "" {
+				id = newRequestID()
+				req.Headers.Set(RequestIDHeader, id)
+			}
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				h.Set(RequestIDHeader, id)
+			})
+			next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+		}
+	}
+}
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID set by the RequestID middleware, or ""
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Timing adds an X-Response-Time header with the time spent before the
+// response headers were written
+func Timing() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				h.Set("X-Response-Time", fmt.Sprintf("%.3fms", float64(time.Since(start).Microseconds())/1000))
+			})
+			next(w, req)
+		}
+	}
+}
+
+// newRequestID returns 16 random bytes hex encoded
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
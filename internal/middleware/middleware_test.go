@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/h0dy/tcp-to-http/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufLogger struct {
+	bytes.Buffer
+}
+
+func (l *bufLogger) Printf(format string, v ...any) {
+	fmt.Fprintf(&l.Buffer, format+"\n", v...)
+}
+
+// serve runs a raw request through h and parses the response it writes
+func serve(t *testing.T, h server.Handler, raw string) *http.Response {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	h(response.NewWriter(buf), req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func hello(w *response.Writer, _ *request.Request) {
+	w.WriteStatusLine(response.Created)
+	body := []byte("hello")
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestChain(t *testing.T) {
+	// Test: First middleware is the outermost
+	var order []string
+	mw := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name)
+				next(w, req)
+			}
+		}
+	}
+	h := server.Chain(hello, mw("a"), mw("b"), mw("c"))
+	serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, []string{"a", "b", "c"}, order)
+}
+
+func TestLogging(t *testing.T) {
+	// Test: Status and bytes written are logged
+	logger := &bufLogger{}
+	h := server.Chain(hello, Logging(logger))
+	serve(t, h, "GET /greet HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, logger.String(), "- GET /greet 201 5B")
+}
+
+func TestRecover(t *testing.T) {
+	logger := &bufLogger{}
+
+	// Test: Panic before writing anything gives a 500
+	h := server.Chain(func(*response.Writer, *request.Request) {
+		panic("boom")
+	}, Recover(logger))
+	resp := serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Contains(t, logger.String(), "boom")
+
+	// Test: Panic after committing keeps the handler's status
+	h = server.Chain(func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		panic("late boom")
+	}, Recover(logger))
+	resp = serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRequestID(t *testing.T) {
+	var seen, fromContext string
+	h := server.Chain(func(w *response.Writer, req *request.Request) {
+		seen, _ = req.Headers.Get("x-request-id")
+		fromContext = RequestIDFromContext(req.Context())
+		hello(w, req)
+	}, RequestID())
+
+	// Test: ID is generated and echoed
+	resp := serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, resp.Header.Get(RequestIDHeader))
+
+	// Test: ID is on the request context
+	assert.Equal(t, seen, fromContext)
+
+	// Test: Client's ID is kept
+	resp = serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: abc\r\n\r\n")
+	assert.Equal(t, "abc", seen)
+	assert.Equal(t, "abc", resp.Header.Get(RequestIDHeader))
+}
+
+func TestTiming(t *testing.T) {
+	// Test: Timing header is added to the handler's headers
+	h := server.Chain(hello, Timing())
+	resp := serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(resp.Header.Get("X-Response-Time"), "ms"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
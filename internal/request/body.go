@@ -0,0 +1,86 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrBodyReadAfterClose is returned when reading a body that was closed
+var ErrBodyReadAfterClose = errors.New("error: read on closed request body")
+
+// NoBody is the Body of requests without one
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// body streams a request body from the connection, the framing
+// (Content-Length or chunked) is enforced by the parser states
+type body struct {
+	req    *Request
+	parser *Parser
+	err    error // sticky error, a failed body can't be resumed
+	closed bool
+}
+
+// Read reads the next decoded body bytes, it returns io.EOF once the whole
+// body (and the trailers of a chunked body) has been read
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	return b.read(p)
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.req.state == requestDone {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := b.parser.readBody(b.req, p)
+	if err != nil {
+		b.err = err
+		return n, err
+	}
+	if n == 0 && b.req.state == requestDone {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// fail makes err, at the current offset of the request, the sticky error of
+// the body and returns it
+func (b *body) fail(err error) error {
+	if b.err == nil {
+		b.err = &ParseError{Err: err, Offset: b.req.offset}
+	}
+	return b.err
+}
+
+// Close discards the rest of the body so the next request on the
+// connection can be parsed
+func (b *body) Close() error {
+	if b.closed {
+		return b.err
+	}
+	b.closed = true
+
+	buf := make([]byte, 512)
+	for {
+		_, err := b.read(buf)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
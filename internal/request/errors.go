@@ -0,0 +1,63 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/h0dy/tcp-to-http/internal/headers"
+)
+
+var (
+	// ErrMalformedRequestLine is returned for a request-line that isn't
+	// method SP request-target SP HTTP-version
+	ErrMalformedRequestLine = errors.New("error: malformed request-line")
+	// ErrInvalidMethod is returned for a method that isn't made of uppercase letters
+	ErrInvalidMethod = errors.New("error: invalid method")
+	// ErrUnsupportedVersion is returned for a request with an HTTP major
+	// version other than 1
+	ErrUnsupportedVersion = errors.New("error: unsupported HTTP version")
+	// ErrInvalidHeader is returned for a malformed header or trailer field
+	// line, the error chain holds a *headers.FieldError
+	ErrInvalidHeader = headers.ErrInvalidField
+	// ErrMalformedChunk is returned for a chunk-size line that can't be parsed
+	ErrMalformedChunk = errors.New("error: malformed chunk")
+	// ErrLengthMismatch is returned when chunk data is longer than its size
+	ErrLengthMismatch = errors.New("error: body longer than its declared length")
+	// ErrUnexpectedEOF is returned when the connection is closed in the
+	// middle of a request, it is also an io.ErrUnexpectedEOF
+	ErrUnexpectedEOF = fmt.Errorf("error: request cut short: %w", io.ErrUnexpectedEOF)
+)
+
+// ParseError is returned for a request that can't be parsed, Err matches
+// one of the Err variables of this package with errors.Is (or is a
+// *TargetError)
+type ParseError struct {
+	Err    error
+	Offset int64 // offset of the offending byte from the start of the request
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error() + " (at offset " + strconv.FormatInt(e.Offset, 10) + ")"
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseError turns err, met at offset at of the data being parsed, into a
+// *ParseError. A *ParseError or *headers.FieldError err has an offset
+// relative to at that is added in
+func (r *Request) parseError(err error, at int) error {
+	offset := r.offset + int64(at)
+	if parseErr, ok := err.(*ParseError); ok {
+		parseErr.Offset += offset
+		return parseErr
+	}
+	var fieldErr *headers.FieldError
+	if errors.As(err, &fieldErr) {
+		offset += int64(fieldErr.Offset)
+	}
+	return &ParseError{Err: err, Offset: offset}
+}
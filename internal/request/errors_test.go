@@ -0,0 +1,67 @@
+package request
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/h0dy/tcp-to-http/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		err    error
+		offset int64
+	}{
+		{"malformed request-line", "GET /\r\n\r\n", ErrMalformedRequestLine, 0},
+		{"unrecognized version", "GET / HTTPS/1.1\r\n\r\n", ErrMalformedRequestLine, 6},
+		{"invalid method", "GeT / HTTP/1.1\r\n\r\n", ErrInvalidMethod, 1},
+		{"empty method", " / HTTP/1.1\r\n\r\n", ErrInvalidMethod, 0},
+		{"unsupported version", "GET / HTTP/2.0\r\n\r\n", ErrUnsupportedVersion, 6},
+		{"invalid header", "GET / HTTP/1.1\r\nHost: a\r\nX-A : b\r\n\r\n", ErrInvalidHeader, 28},
+		{"invalid header value", "GET / HTTP/1.1\r\nHost: a\x00\r\n\r\n", ErrInvalidHeader, 23},
+		{"body too large", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999\r\n\r\n", ErrBodyTooLarge, 57},
+		{"cut short", "GET / HTTP/1.1\r\nHost: a\r\n", ErrUnexpectedEOF, 25},
+	}
+	for _, tc := range tests {
+		p := NewParser(&chunkReader{data: tc.raw, numBytesPerRead: 3})
+		p.Limits.MaxBodyBytes = 10 << 20
+		_, err := p.ReadRequest()
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr, tc.name)
+		assert.ErrorIs(t, err, tc.err, tc.name)
+		assert.Equal(t, tc.offset, parseErr.Offset, tc.name)
+	}
+
+	// Test: Invalid headers carry the field error
+	_, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\nX-A : b\r\n\r\n"))
+	var fieldErr *headers.FieldError
+	require.ErrorAs(t, err, &fieldErr)
+	assert.Equal(t, "whitespace before the colon", fieldErr.Reason)
+
+	// Test: Invalid targets carry the target error
+	_, err = RequestFromReader(strings.NewReader("GET /%zz HTTP/1.1\r\nHost: a\r\n\r\n"))
+	var targetErr *TargetError
+	require.ErrorAs(t, err, &targetErr)
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, int64(4), parseErr.Offset)
+
+	// Test: Chunk data longer than its size, and a body cut short
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrLengthMismatch)
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, int64(61), parseErr.Offset)
+
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nab"))
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrUnexpectedEOF)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
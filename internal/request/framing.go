@@ -0,0 +1,71 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/h0dy/tcp-to-http/internal/headers"
+)
+
+// Errors for requests whose body framing is ambiguous or unsupported. A
+// front-end and a back-end could read the body of such requests differently,
+// which is how requests get smuggled past the front-end
+var (
+	// ErrConflictingFraming is returned when a request has both
+	// Transfer-Encoding and Content-Length
+	ErrConflictingFraming = errors.New("error: both Transfer-Encoding and Content-Length")
+	// ErrInvalidTransferEncoding is returned when chunked isn't the last
+	// transfer coding exactly once, or for Transfer-Encoding in HTTP/1.0
+	ErrInvalidTransferEncoding = errors.New("error: invalid Transfer-Encoding")
+	// ErrUnsupportedTransferCoding is returned for a transfer coding other
+	// than chunked, which is the only one the parser decodes
+	ErrUnsupportedTransferCoding = errors.New("error: unsupported transfer coding")
+	// ErrInvalidContentLength is returned for a Content-Length that isn't a
+	// decimal number fitting an int64 (e.g. negative or overflowing)
+	ErrInvalidContentLength = headers.ErrInvalidContentLength
+	// ErrConflictingContentLength is returned when repeated Content-Length
+	// values differ, it is also an ErrInvalidContentLength
+	ErrConflictingContentLength = headers.ErrConflictingContentLength
+)
+
+// bodyFraming works out how the body is delimited once the headers are
+// parsed: chunked, or length bytes with -1 meaning there is no body
+func (r *Request) bodyFraming() (chunked bool, length int64, err error) {
+	codings := r.Headers.Values("transfer-encoding")
+	if len(codings) == 0 {
+		length, err := r.Headers.ContentLength()
+		return false, length, err
+	}
+
+	if _, ok := r.Headers.Get("content-length"); ok {
+		return false, 0, ErrConflictingFraming
+	}
+	// RFC 9112 section 6.1, HTTP/1.0 has no transfer codings
+	if r.RequestLine.HttpVersion == "1.0" {
+		return false, 0, fmt.Errorf("%w: not allowed in HTTP/1.0", ErrInvalidTransferEncoding)
+	}
+
+	var list []string
+	for _, value := range codings {
+		for coding := range strings.SplitSeq(value, ",") {
+			// the list may have empty elements
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" {
+				list = append(list, coding)
+			}
+		}
+	}
+	if len(list) == 0 {
+		return false, 0, fmt.Errorf("%w: empty", ErrInvalidTransferEncoding)
+	}
+	for _, coding := range list {
+		if coding != "chunked" {
+			return false, 0, fmt.Errorf("%w: %q", ErrUnsupportedTransferCoding, coding)
+		}
+	}
+	if len(list) > 1 {
+		return false, 0, fmt.Errorf("%w: chunked applied more than once", ErrInvalidTransferEncoding)
+	}
+	return true, 0, nil
+}
@@ -0,0 +1,61 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyFraming(t *testing.T) {
+	parse := func(fields string) (*Request, error) {
+		return RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\n0\r\n\r\n"))
+	}
+
+	// Test: Chunked, in any case and with empty list elements
+	r, err := parse("Transfer-Encoding: , Chunked\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "", readBody(t, r))
+
+	// Test: Transfer-Encoding and Content-Length together
+	_, err = parse("Transfer-Encoding: chunked\r\nContent-Length: 5\r\n")
+	assert.ErrorIs(t, err, ErrConflictingFraming)
+	_, err = parse("Content-Length: 5\r\nTransfer-Encoding: chunked\r\n")
+	assert.ErrorIs(t, err, ErrConflictingFraming)
+
+	// Test: Transfer codings other than chunked
+	_, err = parse("Transfer-Encoding: gzip, chunked\r\n")
+	assert.ErrorIs(t, err, ErrUnsupportedTransferCoding)
+	_, err = parse("Transfer-Encoding: chunked;ext=1\r\n")
+	assert.ErrorIs(t, err, ErrUnsupportedTransferCoding)
+	_, err = parse("Transfer-Encoding: xchunked\r\n")
+	assert.ErrorIs(t, err, ErrUnsupportedTransferCoding)
+
+	// Test: chunked more than once, or no coding at all
+	_, err = parse("Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n")
+	assert.ErrorIs(t, err, ErrInvalidTransferEncoding)
+	_, err = parse("Transfer-Encoding: ,\r\n")
+	assert.ErrorIs(t, err, ErrInvalidTransferEncoding)
+
+	// Test: Transfer-Encoding in HTTP/1.0
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidTransferEncoding)
+
+	// Test: Differing duplicate Content-Length
+	_, err = parse("Content-Length: 5\r\nContent-Length: 6\r\n")
+	assert.ErrorIs(t, err, ErrConflictingContentLength)
+	_, err = parse("Content-Length: 5, 6\r\n")
+	assert.ErrorIs(t, err, ErrConflictingContentLength)
+
+	// Test: Negative and overflowing Content-Length
+	_, err = parse("Content-Length: -1\r\n")
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+	_, err = parse("Content-Length: 9223372036854775808\r\n")
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Identical duplicate Content-Length is fine
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	assert.Equal(t, "hi", readBody(t, r))
+}
@@ -0,0 +1,89 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidHost is returned when an HTTP/1.1 request has no Host header,
+// more than one, or one that isn't a valid host[:port]
+var ErrInvalidHost = errors.New("error: invalid Host header")
+
+// setHost checks the Host header once the headers are parsed and fills
+// r.Host and r.Port. They come from the target in absolute-form and
+// authority-form, which wins over the header (RFC 9112 section 3.2.2)
+func (r *Request) setHost() error {
+	values := r.Headers.Values("host")
+	if len(values) == 0 && r.RequestLine.HttpVersion != "1.0" {
+		return fmt.Errorf("%w: missing", ErrInvalidHost)
+	}
+	if len(values) > 1 {
+		return fmt.Errorf("%w: sent more than once", ErrInvalidHost)
+	}
+	// the header must be valid even when the target overrides it
+	var host, port string
+	if len(values) == 1 && values[0] != "" {
+		var err error
+		host, port, err = splitHost(values[0])
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrInvalidHost, values[0], err)
+		}
+	}
+
+	if r.Target.Form == AbsoluteForm || r.Target.Form == AuthorityForm {
+		var err error
+		host, port, err = splitHost(r.Target.Host)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrInvalidHost, r.Target.Host, err)
+		}
+	}
+	r.Host = host
+	r.Port = port
+	return nil
+}
+
+// splitHost splits a host[:port] into its normalized host (lowercase, no
+// trailing dot, no IPv6 brackets) and port
+func splitHost(authority string) (host, port string, err error) {
+	host = authority
+	if i := strings.LastIndexByte(authority, ':'); i != -1 && !strings.HasSuffix(authority, "]") {
+		host, port = authority[:i], authority[i+1:]
+		if port != "" {
+			if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+				return "", "", fmt.Errorf("invalid port %q", port)
+			}
+		}
+	}
+
+	if strings.HasPrefix(host, "[") {
+		ip := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if len(ip) != len(host)-2 || net.ParseIP(ip) == nil || !strings.Contains(ip, ":") {
+			return "", "", errors.New("invalid IPv6 literal")
+		}
+		return strings.ToLower(ip), port, nil
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return "", "", errors.New("empty host")
+	}
+	for i := 0; i < len(host); i++ {
+		if !isRegNameChar(host[i]) {
+			return "", "", fmt.Errorf("invalid character %q", host[i])
+		}
+	}
+	return host, port, nil
+}
+
+// isRegNameChar reports whether c can appear in a reg-name (RFC 3986),
+// apart from the comma which only shows up in a list of hosts
+func isRegNameChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("-._~%!$&'()*+;=", c) != -1
+}
@@ -0,0 +1,65 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHost(t *testing.T) {
+	parse := func(raw string) (*Request, error) {
+		return RequestFromReader(strings.NewReader(raw))
+	}
+
+	// Test: Host and port are normalized
+	r, err := parse("GET / HTTP/1.1\r\nHost: WWW.Example.COM.:8080\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", r.Host)
+	assert.Equal(t, "8080", r.Port)
+
+	// Test: IPv6 literals lose their brackets
+	r, err = parse("GET / HTTP/1.1\r\nHost: [::1]:443\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "::1", r.Host)
+	assert.Equal(t, "443", r.Port)
+	r, err = parse("GET / HTTP/1.1\r\nHost: [::1]\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "::1", r.Host)
+	assert.Equal(t, "", r.Port)
+
+	// Test: Absolute-form target wins over the header
+	r, err = parse("GET http://target.example/ HTTP/1.1\r\nHost: header.example\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "target.example", r.Host)
+
+	// Test: Empty Host is allowed, HTTP/1.0 may leave it out
+	r, err = parse("OPTIONS * HTTP/1.1\r\nHost:\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Host)
+	r, err = parse("GET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Host)
+
+	// Test: Invalid Host headers
+	invalid := []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a.example\r\nHost: a.example\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: exa mple.com\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com:http\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com:99999\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: user@example.com\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: [::1\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: [example.com]\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: :8080\r\n\r\n",
+		// the target wins but the header must still be valid
+		"GET http://a/ HTTP/1.1\r\nHost: bad host\r\n\r\n",
+		"CONNECT a:443 HTTP/1.1\r\nHost: a:http\r\n\r\n",
+	}
+	for _, raw := range invalid {
+		_, err := parse(raw)
+		assert.ErrorIs(t, err, ErrInvalidHost, raw)
+	}
+}
@@ -0,0 +1,55 @@
+package request
+
+import "errors"
+
+var (
+	// ErrRequestLineTooLong is returned when the request-line exceeds Limits.MaxRequestLineBytes
+	ErrRequestLineTooLong = errors.New("error: request-line too long")
+	// ErrHeadersTooLarge is returned when the header section exceeds Limits.MaxHeaderBytes
+	ErrHeadersTooLarge = errors.New("error: header section too large")
+	// ErrTooManyHeaders is returned when there are more field lines than Limits.MaxHeaderCount
+	ErrTooManyHeaders = errors.New("error: too many header fields")
+	// ErrBodyTooLarge is returned when the body exceeds Limits.MaxBodyBytes,
+	// or by ReadBody when it exceeds Limits.MaxReadBodyBytes
+	ErrBodyTooLarge = errors.New("error: body too large")
+)
+
+// maxChunkSizeLineBytes bounds a chunk-size line including its extensions
+const maxChunkSizeLineBytes = 4096
+
+// Limits bounds the input a Parser accepts, a zero field means no limit
+type Limits struct {
+	MaxRequestLineBytes int   // length of the request-line, without CRLF
+	MaxHeaderBytes      int   // total size of the header section (trailers count too)
+	MaxHeaderCount      int   // number of header field lines (trailers count too)
+	MaxBodyBytes        int64 // size of the decoded body, however it is read
+	MaxReadBodyBytes    int64 // size of the body Request.ReadBody reads into memory
+}
+
+// DefaultLimits returns the limits used by NewParser. Streamed bodies are
+// unlimited so handlers can take large uploads by reading Body, only
+// ReadBody, which holds the whole body in memory, is bounded
+func DefaultLimits() Limits {
+	return Limits{
+		MaxRequestLineBytes: 8 << 10,
+		MaxHeaderBytes:      64 << 10,
+		MaxHeaderCount:      100,
+		MaxReadBodyBytes:    10 << 20,
+	}
+}
+
+// exceeds reports whether n is over limit, a zero limit is unlimited
+func exceeds[T int | int64](n, limit T) bool {
+	return limit > 0 && n > limit
+}
+
+// lineLength returns the length of the line at the start of data without
+// its CRLF, or the length of data if the line isn't complete yet
+func lineLength(data []byte) int {
+	for i := range data {
+		if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			return i
+		}
+	}
+	return len(data)
+}
@@ -2,11 +2,15 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/h0dy/tcp-to-http/internal/headers"
 )
@@ -18,15 +22,41 @@ const (
 	requestDone
 	requestParsingHeader
 	requestParsingBody
+	requestParsingLengthBody
+	requestParsingChunkSize
+	requestParsingChunkData
+	requestParsingChunkEnd
+	requestParsingTrailers
 )
 
 // Request represents an HTTP request
 type Request struct {
-	state          requestState    // current parsing state
-	RequestLine    RequestLine     // HTTP method, target path, and HTTP version
-	Headers        headers.Headers // HTTP headers
-	Body           []byte          // request body
-	bodyLengthRead int             // track of body bytes already read (parsed)
+	state          requestState         // current parsing state
+	RequestLine    RequestLine          // HTTP method, target path, and HTTP version
+	Target         Target               // RequestLine.RequestTarget parsed into its path and query
+	Host           string               // host the request is for, lowercase without port or IPv6 brackets
+	Port           string               // port the request is for, "" if the client didn't give one
+	Headers        *headers.Headers     // HTTP headers
+	Body           io.ReadCloser        // request body, read from the connection on demand
+	Trailers       *headers.Headers     // trailer fields, filled once a chunked body is read
+	PathParams     map[string]string    // params matched by the router, e.g. {id}
+	TLS            *tls.ConnectionState // TLS version, cipher, SNI and peer certs, nil over plaintext
+	RemoteAddr     net.Addr             // address of the client, a *net.UnixAddr over a Unix socket
+	LocalAddr      net.Addr             // address of the server the request was received on
+	ConnID         uint64               // ID of the connection, unique within a server
+	Seq            int                  // position of the request on its connection, starting at 1
+	ReceivedAt     time.Time            // when the first byte of the request was received
+	ctx            context.Context      // see Context, nil means context.Background()
+	limits         Limits               // limits of the parser that created the request
+	obsFold        headers.FoldMode     // obs-fold handling of the parser that created the request
+	offset         int64                // bytes of the request parsed so far
+	headerBytes    int                  // size of the header and trailer sections so far
+	headerCount    int                  // number of header and trailer field lines so far
+	bodyLengthRead int64                // track of body bytes already read (parsed)
+	bodyRemaining  int64                // bytes left in the body or in the current chunk
+	bodyDst        []byte               // destination for body bytes while a read is in progress
+	body           *body                // the Body as read from the connection, nil without one
+	bodyDstN       int                  // bytes written to bodyDst so far
 }
 
 // RequestLine represents the start line in HTTP request
@@ -41,68 +71,271 @@ const (
 	bufferSize = 8
 )
 
+// Parser reads consecutive requests from the same reader, keeping any bytes
+// past the end of one request in its buffer for the next one
+type Parser struct {
+	Limits    Limits           // bounds applied to every request read
+	ObsFold   headers.FoldMode // what to do with folded header lines, rejected by default
+	reader    io.Reader
+	buf       []byte   // buffer holding incoming bytes
+	readToIdx int      // bytes we currently have
+	current   *Request // last request returned, its body may still be unread
+}
+
+// NewParser returns a Parser reading requests from reader
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{
+		Limits: DefaultLimits(),
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// RequestFromReader parses a single request from reader
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	// buffer holding incoming bytes
-	buf := make([]byte, bufferSize)
+	return NewParser(reader).ReadRequest()
+}
+
+// Wait blocks until the first byte of the next request is buffered, letting
+// callers apply a different timeout to idle time than to reading a request.
+// Any unread body of the previous request is discarded first. It returns
+// io.EOF if the reader is closed cleanly before that
+func (p *Parser) Wait() error {
+	if err := p.discardCurrent(); err != nil {
+		return err
+	}
+	for p.readToIdx == 0 {
+		n, err := p.fill()
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardCurrent discards the unread body of the last request returned
+func (p *Parser) discardCurrent() error {
+	if p.current == nil {
+		return nil
+	}
+	if err := p.current.Body.Close(); err != nil {
+		return err
+	}
+	p.current = nil
+	return nil
+}
+
+// ReadRequest parses the next request up to the end of its headers, the body
+// is left on the connection for Request.Body. Any unread body of the previous
+// request is discarded first. It returns io.EOF if the reader is closed
+// cleanly before any byte of a new request arrives
+func (p *Parser) ReadRequest() (*Request, error) {
+	if err := p.discardCurrent(); err != nil {
+		return nil, err
+	}
 
-	// bytes we currently have
-	readToIdx := 0
 	request := &Request{
-		state:   requestInitialized,
-		Headers: headers.NewHeaders(),
-		Body:    make([]byte, 0),
+		state:    requestInitialized,
+		limits:   p.Limits,
+		obsFold:  p.ObsFold,
+		Headers:  headers.NewHeaders(),
+		Body:     NoBody,
+		Trailers: headers.NewHeaders(),
 	}
 
-	for request.state != requestDone {
-		// grow buffer if full
-		if readToIdx >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+	for {
+		// parse the data we currently have, a previous request may have
+		// left (part of) this one in the buffer
+		numBytesParsed, err := request.parse(p.buf[:p.readToIdx])
+		if err != nil {
+			return nil, err
 		}
+		p.consume(numBytesParsed)
 
-		// read new bytes into the end of buffer
-		n, err := reader.Read(buf[readToIdx:])
+		if request.state == requestDone {
+			return request, nil
+		}
+		if request.inBody() {
+			request.body = &body{req: request, parser: p}
+			request.Body = request.body
+			p.current = request
+			return request, nil
+		}
+
+		n, err := p.fill()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				if request.state != requestDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", request.state, n)
+				if n > 0 {
+					continue
+				}
+				if request.state == requestInitialized && p.readToIdx == 0 {
+					return nil, io.EOF
 				}
-				break
+				return nil, request.parseError(ErrUnexpectedEOF, p.readToIdx)
 			}
 			return nil, err
 		}
+	}
+}
 
-		// update how many bytes we have for parsing
-		readToIdx += n
+// readBody parses the body of r into dst, reading from the connection only
+// when the buffered bytes don't hold any body data
+func (p *Parser) readBody(r *Request, dst []byte) (int, error) {
+	r.bodyDst = dst
+	r.bodyDstN = 0
+	defer func() { r.bodyDst = nil }()
 
-		// parse the data we currently have
-		numBytesParsed, err := request.parse(buf[:readToIdx])
+	for {
+		numBytesParsed, err := r.parse(p.buf[:p.readToIdx])
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
+		p.consume(numBytesParsed)
+
+		if r.bodyDstN > 0 || r.state == requestDone {
+			return r.bodyDstN, nil
+		}
+
+		n, err := p.fill()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if n > 0 {
+					continue
+				}
+				return 0, r.parseError(ErrUnexpectedEOF, p.readToIdx)
+			}
+			return 0, err
+		}
+	}
+}
+
+// consume drops n parsed bytes, shifting the remaining (unparsed) bytes to
+// the front of the buffer
+func (p *Parser) consume(n int) {
+	copy(p.buf, p.buf[n:p.readToIdx])
+	p.readToIdx -= n
+}
+
+// fill reads new bytes into the end of the buffer, growing it if full
+func (p *Parser) fill() (int, error) {
+	if p.readToIdx >= len(p.buf) {
+		newBuf := make([]byte, len(p.buf)*2)
+		copy(newBuf, p.buf)
+		p.buf = newBuf
+	}
+
+	n, err := p.reader.Read(p.buf[p.readToIdx:])
+	p.readToIdx += n
+	return n, err
+}
+
+// BodyErr returns the *ParseError reading the body failed with, e.g. a
+// chunked body over Limits.MaxBodyBytes, or nil. It doesn't read the body
+func (r *Request) BodyErr() error {
+	if r.body == nil {
+		return nil
+	}
+	var parseErr *ParseError
+	if errors.As(r.body.err, &parseErr) {
+		return r.body.err
+	}
+	return nil
+}
+
+// KeepAlive reports whether the client allows the connection to be reused
+// after this request, HTTP/1.0 clients have to ask for it
+func (r *Request) KeepAlive() bool {
+	if r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
 
-		// shift the remaining (unparsed) bytes to the front
-		copy(buf, buf[numBytesParsed:])
-		readToIdx -= numBytesParsed
+// Context returns the request's context. For requests served by the server
+// it is cancelled when the client goes away, the server shuts down or the
+// request times out, otherwise it is context.Background()
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
 
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// the copy shares the body and headers with r
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
 	}
-	return request, nil
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// PathParam returns the value of the named path param matched by the router,
+// or "" if there is none
+func (r *Request) PathParam(name string) string {
+	return r.PathParams[name]
+}
+
+// ReadBody reads the whole body, a convenience for handlers expecting
+// small bodies. A body over Limits.MaxReadBodyBytes fails with
+// ErrBodyTooLarge like one over MaxBodyBytes, see BodyErr
+func (r *Request) ReadBody() ([]byte, error) {
+	limit := r.limits.MaxReadBodyBytes
+	if limit <= 0 || r.body == nil {
+		return io.ReadAll(r.Body)
+	}
+	// don't read a body announced too large for nothing
+	if length, err := r.Headers.ContentLength(); err == nil && length > limit {
+		return nil, r.body.fail(ErrBodyTooLarge)
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return data, err
+	}
+	if int64(len(data)) > limit {
+		return nil, r.body.fail(ErrBodyTooLarge)
+	}
+	return data, nil
+}
+
+// inBody reports whether the headers are done and the body framing is known
+func (r *Request) inBody() bool {
+	switch r.state {
+	case requestParsingLengthBody, requestParsingChunkSize, requestParsingChunkData,
+		requestParsingChunkEnd, requestParsingTrailers:
+		return true
+	}
+	return false
 }
 
 // parse process the incoming raw data
 func (r *Request) parse(data []byte) (int, error) {
 	totalParsed := 0
 	for r.state != requestDone {
+		// stop at the body until someone reads it
+		if r.inBody() && r.bodyDst == nil {
+			break
+		}
+		prevState := r.state
 		n, err := r.parseSingle(data[totalParsed:])
 		if err != nil {
-			return 0, err
+			return 0, r.parseError(err, totalParsed)
 		}
 		totalParsed += n
-		if n == 0 {
+		// stop when we need more data, but keep going if only the state changed
+		if n == 0 && r.state == prevState {
 			break
 		}
 	}
+	r.offset += int64(totalParsed)
 	return totalParsed, nil
 }
 
@@ -112,6 +345,9 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 
 	// requestInitialized case handles the start line part
 	case requestInitialized:
+		if exceeds(lineLength(data), r.limits.MaxRequestLineBytes) {
+			return 0, ErrRequestLineTooLong
+		}
 		request, n, err := parseRequestLine(data)
 		if err != nil {
 			return 0, err
@@ -119,44 +355,118 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if n == 0 { // need more data
 			return 0, nil
 		}
+		target, err := ParseTarget(request.Method, request.RequestTarget)
+		if err != nil {
+			return 0, &ParseError{Err: err, Offset: int64(len(request.Method) + 1)}
+		}
 		r.RequestLine = *request
+		r.Target = target
 		r.state = requestParsingHeader
 		return n, nil
 
 	// requestParsingHeader case handles the headers
 	case requestParsingHeader:
-		n, done, err := r.Headers.Parse(data)
+		n, done, err := r.parseFieldLine(r.Headers, data)
 		if err != nil {
 			return 0, err
 		}
 		if done {
+			if err := r.setHost(); err != nil {
+				return 0, err
+			}
 			r.state = requestParsingBody
 		}
 		return n, nil
 
-	// requestParsingBody case handles the body (if any)
+	// requestParsingBody case works out how the body (if any) is framed
 	case requestParsingBody:
-		lengthVal, ok := r.Headers.Get("content-length")
-		if !ok {
+		chunked, length, err := r.bodyFraming()
+		if err != nil {
+			return 0, err
+		}
+		if chunked {
+			r.state = requestParsingChunkSize
+			return 0, nil
+		}
+		if length == -1 {
+			// without Content-Length there is no body, leave the
+			// remaining bytes for the next request on the connection
+			r.state = requestDone
+			return 0, nil
+		}
+		if exceeds(length, r.limits.MaxBodyBytes) {
+			return 0, ErrBodyTooLarge
+		}
+		if length == 0 {
+			r.state = requestDone
+			return 0, nil
+		}
+		r.bodyRemaining = length
+		r.state = requestParsingLengthBody
+		return 0, nil
+
+	// requestParsingLengthBody case handles a body delimited by Content-Length
+	case requestParsingLengthBody:
+		n := r.copyBody(data)
+		if r.bodyRemaining == 0 {
 			r.state = requestDone
-			return len(data), nil
 		}
+		return n, nil
 
-		length, err := strconv.Atoi(lengthVal)
+	// requestParsingChunkSize case handles the chunk-size line of a chunked body
+	case requestParsingChunkSize:
+		if lineLength(data) > maxChunkSizeLineBytes {
+			return 0, fmt.Errorf("%w: chunk-size line too long", ErrMalformedChunk)
+		}
+		size, n, err := parseChunkSize(data)
 		if err != nil {
-			return 0, fmt.Errorf("error: Content-Length header contains invalid data (non-numeric)")
+			return 0, err
+		}
+		if n == 0 { // need more data
+			return 0, nil
+		}
+		// compare without adding, a huge size would overflow the sum
+		if r.limits.MaxBodyBytes > 0 && size > r.limits.MaxBodyBytes-r.bodyLengthRead {
+			return 0, ErrBodyTooLarge
+		}
+		if size == 0 {
+			// last-chunk, only the trailer section is left
+			r.state = requestParsingTrailers
+			return n, nil
 		}
+		r.bodyRemaining = size
+		r.state = requestParsingChunkData
+		return n, nil
 
-		r.Body = append(r.Body, data...)
-		r.bodyLengthRead += len(data)
+	// requestParsingChunkData case handles the data of the current chunk
+	case requestParsingChunkData:
+		n := r.copyBody(data)
+		if r.bodyRemaining == 0 {
+			r.state = requestParsingChunkEnd
+		}
+		return n, nil
+
+	// requestParsingChunkEnd case handles the CRLF that ends every chunk
+	case requestParsingChunkEnd:
+		if len(data) < len(crlf) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte(crlf)) {
+			return 0, fmt.Errorf("%w: chunk data is not followed by CRLF", ErrLengthMismatch)
+		}
+		r.state = requestParsingChunkSize
+		return len(crlf), nil
 
-		if r.bodyLengthRead > length {
-			return 0, fmt.Errorf("error: body's length doesn't match Content-Length header\nContent-Length: %v, body's length: %v", length, len(data))
+	// requestParsingTrailers case handles the trailer fields after the last chunk
+	case requestParsingTrailers:
+		n, done, err := r.parseFieldLine(r.Trailers, data)
+		if err != nil {
+			return 0, err
 		}
-		if length == len(r.Body) {
+		if done {
 			r.state = requestDone
 		}
-		return len(data), nil
+		return n, nil
 
 	case requestDone:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
@@ -166,6 +476,139 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
+// parseFieldLine parses the next header (or trailer) field line into h,
+// enforcing the header size and count limits
+func (r *Request) parseFieldLine(h *headers.Headers, data []byte) (int, bool, error) {
+	if exceeds(r.headerBytes+lineLength(data), r.limits.MaxHeaderBytes) {
+		return 0, false, ErrHeadersTooLarge
+	}
+	n, done, err := h.ParseWithFolding(data, r.obsFold)
+	if err != nil {
+		return 0, false, err
+	}
+	r.headerBytes += n
+	if n > 0 && !done {
+		r.headerCount++
+		if exceeds(r.headerCount, r.limits.MaxHeaderCount) {
+			return 0, false, ErrTooManyHeaders
+		}
+	}
+	return n, done, nil
+}
+
+// copyBody moves as much of data as belongs to the body and fits into bodyDst
+func (r *Request) copyBody(data []byte) int {
+	n := int(min(r.bodyRemaining, int64(len(data))))
+	n = copy(r.bodyDst[r.bodyDstN:], data[:n])
+	r.bodyDstN += n
+	r.bodyLengthRead += int64(n)
+	r.bodyRemaining -= int64(n)
+	return n
+}
+
+// parseChunkSize reads/parses a chunk-size line, chunk extensions are
+// checked but ignored
+func parseChunkSize(data []byte) (int64, int, error) {
+	idx := bytes.Index(data, []byte(crlf))
+	if idx == -1 {
+		return 0, 0, nil
+	}
+
+	// chunk-size [ BWS ";" chunk-ext ]
+	line, ext, hasExt := bytes.Cut(data[:idx], []byte(";"))
+	if hasExt && !validChunkExt(string(ext)) {
+		return 0, 0, fmt.Errorf("%w: invalid chunk extension %q", ErrMalformedChunk, ext)
+	}
+	sizeStr := strings.TrimRight(string(line), " \t")
+	if sizeStr == "" {
+		return 0, 0, fmt.Errorf("%w: missing chunk size", ErrMalformedChunk)
+	}
+	size, err := strconv.ParseUint(sizeStr, 16, 63)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, sizeStr)
+	}
+
+	return int64(size), idx + 2, nil
+}
+
+// validChunkExt checks the chunk extensions following the first ';' of a
+// chunk-size line (RFC 9112 section 7.1.1):
+//
+//	chunk-ext = *( BWS ";" BWS name [ BWS "=" BWS ( token / quoted-string ) ] )
+//
+// Anything else, a bare LF in particular, could be framed differently by
+// another server
+func validChunkExt(s string) bool {
+	i := 0
+	skipBWS := func() {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+	}
+	token := func() bool {
+		start := i
+		for i < len(s) && isTokenChar(s[i]) {
+			i++
+		}
+		return i > start
+	}
+	quotedString := func() bool {
+		// s[i] is the opening quote
+		for i++; i < len(s); i++ {
+			c := s[i]
+			switch {
+			case c == '"':
+				i++
+				return true
+			case c == '\\':
+				i++
+				if i == len(s) || s[i] != '\t' && (s[i] < ' ' || s[i] == 0x7f) {
+					return false
+				}
+			case c != '\t' && (c < ' ' || c == 0x7f):
+				return false
+			}
+		}
+		return false
+	}
+
+	for {
+		skipBWS()
+		if !token() {
+			return false
+		}
+		skipBWS()
+		if i < len(s) && s[i] == '=' {
+			i++
+			skipBWS()
+			if i < len(s) && s[i] == '"' {
+				if !quotedString() {
+					return false
+				}
+			} else if !token() {
+				return false
+			}
+			skipBWS()
+		}
+		if i == len(s) {
+			return true
+		}
+		if s[i] != ';' {
+			return false
+		}
+		i++
+	}
+}
+
+// isTokenChar reports whether c can appear in a token (RFC 9110 section 5.6.2)
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
 // parseRequestLine reads/parses the start-line
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	idx := bytes.Index(data, []byte(crlf))
@@ -182,35 +625,51 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	return requestLine, idx + 2, nil
 }
 
-// requestLineFromString parses the start line from string to RequestLine
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// requestLineFromString parses the start line from string to RequestLine,
+// errors are a *ParseError with an offset in str
 func requestLineFromString(str string) (*RequestLine, error) {
+	fail := func(offset int, err error) (*RequestLine, error) {
+		return nil, &ParseError{Err: err, Offset: int64(offset)}
+	}
 	lines := strings.Split(str, " ")
 
 	if len(lines) != 3 {
-		return nil, fmt.Errorf("poorly formatted request-line: %s", str)
+		return fail(0, fmt.Errorf("%w: %q", ErrMalformedRequestLine, str))
 	}
 
 	method := lines[0]
 	// check if method is uppercase
-	for _, ch := range method {
+	for i, ch := range method {
 		if ch < 'A' || ch > 'Z' {
-			return nil, fmt.Errorf("invalid method: %s", method)
+			return fail(i, fmt.Errorf("%w: %q", ErrInvalidMethod, method))
 		}
 	}
+	if method == "" {
+		return fail(0, fmt.Errorf("%w: empty", ErrInvalidMethod))
+	}
 
 	target := lines[1]
 
+	versionOffset := len(method) + len(target) + 2
 	httpVersion := strings.Split(lines[2], "/")
-	if len(httpVersion) != 2 {
-		return nil, fmt.Errorf("malformed start-line: %s", str)
-	}
-	http := httpVersion[0]
-	if http != "HTTP" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", http)
+	if len(httpVersion) != 2 || httpVersion[0] != "HTTP" {
+		return fail(versionOffset, fmt.Errorf("%w: unrecognized HTTP-version %q", ErrMalformedRequestLine, lines[2]))
 	}
+	// HTTP-version = "HTTP/" DIGIT "." DIGIT
 	version := httpVersion[1]
-	if version != "1.1" {
-		return nil, fmt.Errorf("unrecognized HTTP-version, we only support 1.1: %s", version)
+	if len(version) != 3 || !isDigit(version[0]) || version[1] != '.' || !isDigit(version[2]) {
+		return fail(versionOffset, fmt.Errorf("%w: malformed HTTP-version %q", ErrMalformedRequestLine, lines[2]))
+	}
+	if version[0] != '1' {
+		return fail(versionOffset, fmt.Errorf("%w: HTTP/%s", ErrUnsupportedVersion, version))
+	}
+	// a later 1.x minor version is served as 1.1, the highest we support
+	if version != "1.0" {
+		version = "1.1"
 	}
 
 	return &RequestLine{
@@ -1,9 +1,12 @@
 package request
 
 import (
+	"context"
 	"io"
+	"strings"
 	"testing"
 
+	"github.com/h0dy/tcp-to-http/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -68,6 +71,44 @@ func TestRequestLineParse(t *testing.T) {
 	}
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// Test: HTTP/1.0 is accepted
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+
+	// Test: A later 1.x minor version is served as 1.1
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.2\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
+
+	// Test: Malformed version
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1\r\nHost: localhost\r\n\r\n"))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestRequestKeepAlive(t *testing.T) {
+	cases := []struct {
+		raw       string
+		keepAlive bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", true},
+	}
+	// Test: HTTP/1.1 is persistent by default, HTTP/1.0 has to ask
+	for _, tc := range cases {
+		r, err := RequestFromReader(strings.NewReader(tc.raw))
+		require.NoError(t, err)
+		assert.Equal(t, tc.keepAlive, r.KeepAlive(), tc.raw)
+	}
 }
 
 type chunkReader struct {
@@ -85,19 +126,19 @@ func TestHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:8080", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:8080", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
-	// Test: Empty Headers
+	// Test: Empty Headers, HTTP/1.0 doesn't need Host
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\n\r\n",
+		data:            "GET / HTTP/1.0\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Empty(t, r.Headers)
+	assert.Zero(t, r.Headers.Len())
 
 	// Test: invalid Header
 	reader = &chunkReader{
@@ -109,13 +150,13 @@ func TestHeadersParse(t *testing.T) {
 
 	// Test: Duplicate Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:8080\r\nHost: duplicate:8080\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost:8080\r\nAccept: text/html\r\nAccept: */*\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:8080, duplicate:8080", r.Headers["host"])
+	assert.Equal(t, []string{"text/html", "*/*"}, r.Headers.Values("accept"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -125,8 +166,8 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:8080", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+	assert.Equal(t, "localhost:8080", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -150,7 +191,7 @@ func TestBodyParser(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "hello world!\n", readBody(t, r))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -161,7 +202,9 @@ func TestBodyParser(t *testing.T) {
 			"partial content",
 		numBytesPerRead: 3,
 	}
-	_, err = RequestFromReader(reader)
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
 	require.Error(t, err)
 
 	// Test: Empty Body, 0 reported content length
@@ -175,8 +218,8 @@ func TestBodyParser(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	require.Equal(t, r.Headers["content-length"], "0")
-	assert.Equal(t, "", string(r.Body))
+	require.Equal(t, get(r.Headers, "content-length"), "0")
+	assert.Equal(t, "", readBody(t, r))
 
 	// Test: Empty Body, no reported content length
 	reader = &chunkReader{
@@ -189,8 +232,8 @@ func TestBodyParser(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	require.Equal(t, r.Headers["user-agent"], "curl/7.81.0")
-	assert.Equal(t, "", string(r.Body))
+	require.Equal(t, get(r.Headers, "user-agent"), "curl/7.81.0")
+	assert.Equal(t, "", readBody(t, r))
 
 	// Test: No Content-Length but Body exists
 	reader = &chunkReader{
@@ -202,7 +245,7 @@ func TestBodyParser(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", readBody(t, r))
 
 	// Test: Content-Length has invalid non-numeric data
 	reader = &chunkReader{
@@ -217,6 +260,325 @@ func TestBodyParser(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestChunkedBodyParser(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:8080\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7\r\n world!\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", readBody(t, r))
+	assert.Zero(t, r.Trailers.Len())
+
+	// Test: Chunk extensions, hex sizes and trailers
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:8080\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"a;name=value\r\n0123456789\r\n" +
+			"1A ; last\r\nabcdefghijklmnopqrstuvwxyz\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789abcdefghijklmnopqrstuvwxyz", readBody(t, r))
+	assert.Equal(t, "abc123", get(r.Trailers, "x-checksum"))
+
+	// Test: Quoted extension values and several extensions
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5 ; a = \"x;\\\"y\" ;b\r\nhello\r\n0;c=d\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// Test: Malformed chunk extensions, a bare LF could be framed
+	// differently by another server
+	for _, ext := range []string{";a\nb", ";a\rb", ";", ";a=", ";=b", ";a b", ";a=\"b", ";a=\"b\x00\"", ";a\x00"} {
+		r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5" + ext + "\r\nhello\r\n0\r\n\r\n"))
+		require.NoError(t, err)
+		_, err = r.ReadBody()
+		assert.ErrorIs(t, err, ErrMalformedChunk, "%q", ext)
+	}
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.Error(t, err)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.Error(t, err)
+
+	// Test: Missing terminating chunk
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.Error(t, err)
+}
+
+func TestParserKeepAlive(t *testing.T) {
+	// Test: Pipelined requests on one connection
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:8080\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:8080\r\n" +
+			"Connection: close\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	}
+	p := NewParser(reader)
+	r, err := p.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", readBody(t, r))
+	assert.True(t, r.KeepAlive())
+
+	r, err = p.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, "", readBody(t, r))
+	assert.False(t, r.KeepAlive())
+
+	// Test: Clean EOF between requests
+	_, err = p.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Whole request already buffered from a previous read
+	reader = &chunkReader{
+		data: "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 64,
+	}
+	p = NewParser(reader)
+	r, err = p.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	r, err = p.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: Unread body is discarded before the next request
+	reader = &chunkReader{
+		data: "POST /a HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n" +
+			"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	p = NewParser(reader)
+	r, err = p.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	r, err = p.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Body is read from the connection on demand
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Content-Length: 26\r\n" +
+			"\r\n" +
+			"abcdefghijklmnopqrstuvwxyz",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Less(t, reader.pos, len(reader.data))
+
+	buf := make([]byte, 4)
+	n, err := r.Body.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd"[:n], string(buf[:n]))
+	rest, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", string(buf[:n])+string(rest))
+
+	// Test: Read after Close
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(buf)
+	assert.ErrorIs(t, err, ErrBodyReadAfterClose)
+
+	// Test: No body
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, NoBody, r.Body)
+}
+
+func TestParserLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        10,
+	}
+	parse := func(data string) (*Request, error) {
+		p := NewParser(&chunkReader{data: data, numBytesPerRead: 4})
+		p.Limits = limits
+		return p.ReadRequest()
+	}
+
+	// Test: Within limits
+	r, err := parse("GET /coffee HTTP/1.1\r\nHost: localhost:8080\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// Test: Request-line too long, even before its CRLF arrives
+	_, err = parse("GET /" + strings.Repeat("a", 64))
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Header section too large
+	_, err = parse("GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 64) + "\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Too many header fields
+	_, err = parse("GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n")
+	assert.ErrorIs(t, err, ErrTooManyHeaders)
+
+	// Test: Content-Length over the body limit
+	_, err = parse("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world")
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body growing over the body limit
+	r, err = parse("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6\r\nhello \r\n6\r\nworld!\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	assert.NoError(t, r.BodyErr())
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.ErrorIs(t, r.WithContext(context.Background()).BodyErr(), ErrBodyTooLarge)
+
+	// Test: A huge chunk size after a first chunk can't overflow the limit
+	r, err = parse("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n7fffffffffffffff\r\n" + strings.Repeat("a", 64))
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Streamed bodies are unlimited by default, ReadBody isn't
+	data := "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world"
+	p := NewParser(strings.NewReader(data))
+	p.Limits.MaxReadBodyBytes = 10
+	r, err = p.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.ErrorIs(t, r.BodyErr(), ErrBodyTooLarge)
+	r, err = RequestFromReader(strings.NewReader(data))
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+
+	// Test: Chunked body growing over the ReadBody limit
+	p = NewParser(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6\r\nhello \r\n6\r\nworld!\r\n0\r\n\r\n"))
+	p.Limits.MaxReadBodyBytes = 10
+	r, err = p.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Zero limits are unlimited
+	p = NewParser(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 10000) + " HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 512,
+	})
+	p.Limits = Limits{}
+	_, err = p.ReadRequest()
+	require.NoError(t, err)
+}
+
+func TestParserObsFold(t *testing.T) {
+	data := "GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: a\r\n  b\r\n\r\n"
+
+	// Test: Folded header lines are rejected by default
+	_, err := NewParser(&chunkReader{data: data, numBytesPerRead: 3}).ReadRequest()
+	require.Error(t, err)
+
+	// Test: Folded header lines are unfolded when asked to
+	p := NewParser(&chunkReader{data: data, numBytesPerRead: 3})
+	p.ObsFold = headers.UnfoldObsFold
+	r, err := p.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "a b", get(r.Headers, "x-long"))
+
+	// Test: A folded Host header can't sneak in a second line
+	_, err = NewParser(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\n\tHost: b\r\n\r\n")).ReadRequest()
+	require.Error(t, err)
+
+	// Test: Bare CR in a header value
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nX: a\rb\r\n\r\n"))
+	require.Error(t, err)
+}
+
+// get returns the first value of key in h, or "" if there is none
+func get(h *headers.Headers, key string) string {
+	val, _ := h.Get(key)
+	return val
+}
+
+// readBody reads the whole body of r, failing the test on error
+func readBody(t *testing.T, r *Request) string {
+	t.Helper()
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	return string(body)
+}
+
 // Read reads up to len(p) or numBytesPerRead bytes from the string per call
 // its useful for simulating reading a variable number of bytes per chunk from a network connection
 func (cr *chunkReader) Read(p []byte) (n int, err error) {
@@ -229,3 +591,24 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 
 	return n, nil
 }
+
+func TestRequestContext(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+
+	// Test: Parsed requests have the background context
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: WithContext copies the request, sharing the body
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, ctx, r2.Context())
+	assert.Equal(t, context.Background(), r.Context())
+	body, err := r2.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(body))
+
+	// Test: nil context panics
+	assert.Panics(t, func() { r.WithContext(nil) })
+}
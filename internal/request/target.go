@@ -0,0 +1,238 @@
+package request
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TargetForm is the form of a request target, see RFC 9112 section 3.2
+type TargetForm int
+
+const (
+	OriginForm    TargetForm = iota // /path?query, the usual form
+	AbsoluteForm                    // http://host/path?query, sent to proxies
+	AuthorityForm                   // host:port, only for CONNECT
+	AsteriskForm                    // *, only for a server-wide OPTIONS
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case OriginForm:
+		return "origin-form"
+	case AbsoluteForm:
+		return "absolute-form"
+	case AuthorityForm:
+		return "authority-form"
+	case AsteriskForm:
+		return "asterisk-form"
+	default:
+		return "unknown"
+	}
+}
+
+// Target is a parsed request target
+type Target struct {
+	Form     TargetForm
+	Scheme   string     // "http" or "https" in absolute-form, lowercase
+	Host     string     // host[:port] in absolute-form and authority-form
+	Path     string     // percent-decoded path without dot segments, "" in authority-form and asterisk-form
+	RawPath  string     // path as sent, still percent-encoded
+	RawQuery string     // query as sent, without the '?'
+	Query    url.Values // decoded query params, empty if there is no query
+}
+
+// TargetError describes a request target that can't be parsed
+type TargetError struct {
+	Target string
+	Reason string
+}
+
+func (e *TargetError) Error() string {
+	return "error: invalid request target " + strconv.Quote(e.Target) + ": " + e.Reason
+}
+
+// ParseTarget parses the target of a request with the given method, the
+// form of the target must fit the method
+func ParseTarget(method, target string) (Target, error) {
+	fail := func(reason string) (Target, error) {
+		return Target{}, &TargetError{Target: target, Reason: reason}
+	}
+	if target == "" {
+		return fail("empty")
+	}
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		if c <= ' ' || c >= 0x7f {
+			return fail("invalid character " + strconv.QuoteRune(rune(c)))
+		}
+		if c == '#' {
+			return fail("fragments are not allowed")
+		}
+	}
+
+	switch {
+	case method == "CONNECT":
+		if err := validAuthority(target, true); err != "" {
+			return fail(err)
+		}
+		return Target{Form: AuthorityForm, Host: target, Query: url.Values{}}, nil
+
+	case target == "*":
+		if method != "OPTIONS" {
+			return fail("* is only allowed for OPTIONS")
+		}
+		return Target{Form: AsteriskForm, Query: url.Values{}}, nil
+
+	case strings.HasPrefix(target, "/"):
+		t := Target{Form: OriginForm}
+		if reason := t.parsePathAndQuery(target); reason != "" {
+			return fail(reason)
+		}
+		return t, nil
+	}
+
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok {
+		return fail("must be a path, an absolute URI, or * for OPTIONS")
+	}
+	scheme = strings.ToLower(scheme)
+	if scheme != "http" && scheme != "https" {
+		return fail("unsupported scheme " + scheme)
+	}
+	end := strings.IndexAny(rest, "/?")
+	if end == -1 {
+		end = len(rest)
+	}
+	host := rest[:end]
+	if err := validAuthority(host, false); err != "" {
+		return fail(err)
+	}
+	t := Target{Form: AbsoluteForm, Scheme: scheme, Host: host}
+	pathAndQuery := rest[end:]
+	if !strings.HasPrefix(pathAndQuery, "/") {
+		pathAndQuery = "/" + pathAndQuery
+	}
+	if reason := t.parsePathAndQuery(pathAndQuery); reason != "" {
+		return fail(reason)
+	}
+	return t, nil
+}
+
+// parsePathAndQuery fills the path and query fields from "/path?query", it
+// returns why they are invalid, or ""
+func (t *Target) parsePathAndQuery(s string) string {
+	rawPath, rawQuery, _ := strings.Cut(s, "?")
+	// dot segments go first, decoding can't make new segments since an
+	// encoded slash is rejected
+	path, ok := removeDotSegments(rawPath)
+	if !ok {
+		return "path goes above the root"
+	}
+	path, reason := unescapePath(path)
+	if reason != "" {
+		return reason
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "invalid query: " + err.Error()
+	}
+
+	t.Path = path
+	t.RawPath = rawPath
+	t.RawQuery = rawQuery
+	t.Query = query
+	return ""
+}
+
+// unescapePath decodes the %XX escapes of a path. It fails on malformed
+// escapes, on escaped control characters such as %00 and on an escaped
+// slash, which would split a segment in two once decoded. It returns why
+// the path is invalid, or ""
+func unescapePath(s string) (string, string) {
+	if !strings.Contains(s, "%") {
+		return s, ""
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", "invalid percent-encoding in path"
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil || c < ' ' || c == 0x7f {
+			return "", "invalid percent-encoding in path"
+		}
+		if c == '/' {
+			return "", "encoded slash in path"
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), ""
+}
+
+// removeDotSegments resolves the "." and ".." segments of a raw path so
+// handlers never see them, "%2e" counts as a dot. It fails if ".." would go
+// above the root
+func removeDotSegments(path string) (string, bool) {
+	if !strings.ContainsAny(path, ".%") {
+		return path, true
+	}
+	segments := strings.Split(path[1:], "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch strings.ReplaceAll(strings.ToLower(segment), "%2e", ".") {
+		case ".":
+		case "..":
+			if len(out) == 0 {
+				return "", false
+			}
+			out = out[:len(out)-1]
+		default:
+			out = append(out, segment)
+			continue
+		}
+		// a trailing dot segment leaves a directory, keep its slash
+		if last {
+			out = append(out, "")
+		}
+	}
+	return "/" + strings.Join(out, "/"), true
+}
+
+// validAuthority checks a host[:port], the port is required for CONNECT.
+// It returns why the authority is invalid, or ""
+func validAuthority(authority string, needPort bool) string {
+	if authority == "" {
+		return "missing host"
+	}
+	if strings.Contains(authority, "@") {
+		return "user info is not allowed"
+	}
+	host, port := authority, ""
+	if h, p, err := net.SplitHostPort(authority); err == nil {
+		host, port = h, p
+	} else if needPort {
+		return "authority must be host:port"
+	} else if strings.HasPrefix(authority, "[") {
+		// an IPv6 literal without a port
+		host = strings.TrimSuffix(strings.TrimPrefix(authority, "["), "]")
+	}
+	if host == "" {
+		return "missing host"
+	}
+	if port != "" || needPort {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return "invalid port " + strconv.Quote(port)
+		}
+	}
+	return ""
+}
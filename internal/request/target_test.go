@@ -0,0 +1,112 @@
+package request
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	// Test: Origin-form with a query
+	target, err := ParseTarget("GET", "/search?q=go&tag=a&tag=b")
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, target.Form)
+	assert.Equal(t, "/search", target.Path)
+	assert.Equal(t, "q=go&tag=a&tag=b", target.RawQuery)
+	assert.Equal(t, "go", target.Query.Get("q"))
+	assert.Equal(t, []string{"a", "b"}, target.Query["tag"])
+
+	// Test: Path is percent-decoded, the raw path is kept
+	target, err = ParseTarget("GET", "/files/a%20b%7Ec")
+	require.NoError(t, err)
+	assert.Equal(t, "/files/a b~c", target.Path)
+	assert.Equal(t, "/files/a%20b%7Ec", target.RawPath)
+	assert.Empty(t, target.Query)
+
+	// Test: Dot segments are removed, even encoded ones
+	target, err = ParseTarget("GET", "/static/css/../%2e/site.css")
+	require.NoError(t, err)
+	assert.Equal(t, "/static/site.css", target.Path)
+	target, err = ParseTarget("GET", "/a/b/..")
+	require.NoError(t, err)
+	assert.Equal(t, "/a/", target.Path)
+	target, err = ParseTarget("GET", "/public/%2E%2e/admin")
+	require.NoError(t, err)
+	assert.Equal(t, "/admin", target.Path)
+
+	// Test: Decoding can't create dot segments or new segments
+	target, err = ParseTarget("GET", "/public/.%2e.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "/public/...txt", target.Path)
+
+	// Test: Absolute-form
+	target, err = ParseTarget("GET", "HTTP://example.com:8080/home?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, target.Form)
+	assert.Equal(t, "http", target.Scheme)
+	assert.Equal(t, "example.com:8080", target.Host)
+	assert.Equal(t, "/home", target.Path)
+	assert.Equal(t, url.Values{"x": {"1"}}, target.Query)
+	target, err = ParseTarget("GET", "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "/", target.Path)
+
+	// Test: Authority-form for CONNECT
+	target, err = ParseTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, target.Form)
+	assert.Equal(t, "example.com:443", target.Host)
+	assert.Equal(t, "", target.Path)
+
+	// Test: Asterisk-form for OPTIONS
+	target, err = ParseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, target.Form)
+
+	// Test: Invalid targets
+	invalid := []struct {
+		method, target, reason string
+	}{
+		{"GET", "*", "only allowed for OPTIONS"},
+		{"GET", "home", "must be a path"},
+		{"GET", "/a%zzb", "percent-encoding"},
+		{"GET", "/a%2", "percent-encoding"},
+		{"GET", "/a%00b", "percent-encoding"},
+		{"GET", "/../etc/passwd", "above the root"},
+		{"GET", "/%2e%2e/etc/passwd", "above the root"},
+		{"GET", "/public/..%2Fadmin", "encoded slash"},
+		{"GET", "/public/..%2fadmin", "encoded slash"},
+		{"GET", "/a%2F..%2F..%2Fetc", "encoded slash"},
+		{"GET", "/a?x=%zz", "invalid query"},
+		{"GET", "/a#frag", "fragments"},
+		{"GET", "/caf\xc3\xa9", "invalid character"},
+		{"GET", "ftp://example.com/", "unsupported scheme"},
+		{"GET", "http://user@example.com/", "user info"},
+		{"GET", "http:///path", "missing host"},
+		{"GET", "http://example.com:http/", "invalid port"},
+		{"CONNECT", "example.com", "host:port"},
+		{"CONNECT", "/path", "host:port"},
+		{"CONNECT", "example.com:0", "invalid port"},
+	}
+	for _, tc := range invalid {
+		_, err := ParseTarget(tc.method, tc.target)
+		var targetErr *TargetError
+		if assert.ErrorAs(t, err, &targetErr, tc.target) {
+			assert.Contains(t, targetErr.Reason, tc.reason, tc.target)
+		}
+	}
+
+	// Test: The parser rejects an invalid target
+	_, err = RequestFromReader(strings.NewReader("GET /../x HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	var targetErr *TargetError
+	assert.ErrorAs(t, err, &targetErr)
+
+	// Test: The parser fills Request.Target
+	r, err := RequestFromReader(strings.NewReader("GET /home?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/home", r.Target.Path)
+	assert.Equal(t, "1", r.Target.Query.Get("x"))
+}
@@ -7,12 +7,11 @@ import (
 	"github.com/h0dy/tcp-to-http/internal/headers"
 )
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	headers := headers.NewHeaders()
 	headers.Set("Date", formateHTTPDate(time.Now()))
 	headers.Set("Content-Type", "text/plain")
 	headers.Set("Content-Length", strconv.Itoa(contentLen))
-	headers.Set("Connection", "close")
 	return headers
 }
 
@@ -1,36 +1,205 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/h0dy/tcp-to-http/internal/headers"
 )
 
-// Writer provides methods to write HTTP responses
+type writerState int
+
+const (
+	writerStatusLine  writerState = iota // nothing written yet
+	writerHeaders                        // status line written
+	writerBody                           // headers written, body delimited by Content-Length (if any)
+	writerChunkedBody                    // headers written, chunked body
+	writerTrailers                       // final chunk written, trailers left
+	writerDone                           // trailers written, the response is complete
+)
+
+func (s writerState) String() string {
+	switch s {
+	case writerStatusLine:
+		return "status line"
+	case writerHeaders:
+		return "headers"
+	case writerBody:
+		return "body"
+	case writerChunkedBody:
+		return "chunked body"
+	case writerTrailers:
+		return "trailers"
+	case writerDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrWriterState is returned when a Writer method is called out of order
+var ErrWriterState = errors.New("error: response written out of order")
+
+// Writer provides methods to write HTTP responses, it enforces the
+// status line -> headers -> body (-> trailers) order
 type Writer struct {
-	writer io.Writer
+	writer         io.Writer
+	state          writerState
+	version        string // HTTP version of the status line
+	method         string // method of the request being answered
+	noBody         bool   // the response ends with its headers, body writes are dropped
+	closeDelimited bool   // the body ends when the connection closes, chunks aren't framed
+	keepAlive      bool   // the written headers allow reusing the connection
+	statusCode     StatusCode
+	contentLength  int64 // value of the Content-Length header, -1 if not sent
+	bodyWritten    int64 // body bytes written so far (without chunk framing)
+	headerHooks    []func(*headers.Headers)
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		writer: w,
+		writer:        w,
+		version:       "1.1",
+		contentLength: -1,
+	}
+}
+
+// SetVersion sets the HTTP version of the request being answered, e.g.
+// "1.0". The status line carries it, and an HTTP/1.0 client gets the body
+// of a chunked response unframed, ended by closing the connection. It has
+// no effect once the status line is written
+func (w *Writer) SetVersion(version string) {
+	if w.state == writerStatusLine {
+		w.version = version
 	}
 }
 
+// SetMethod sets the method of the request being answered, a response to
+// HEAD ends with its headers and anything written to its body is dropped
+func (w *Writer) SetMethod(method string) {
+	w.method = method
+}
+
+// Committed reports whether anything has been written to the connection,
+// once committed the status and headers can't be changed
+func (w *Writer) Committed() bool {
+	return w.state != writerStatusLine
+}
+
+// StatusCode returns the status code written so far, or 0 before the status line
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes written so far, without
+// the chunked framing
+func (w *Writer) BytesWritten() int64 {
+	return w.bodyWritten
+}
+
+// OnWriteHeaders registers fn to run right before the headers are written,
+// letting middlewares add headers to responses they don't produce
+func (w *Writer) OnWriteHeaders(fn func(h *headers.Headers)) {
+	w.headerHooks = append(w.headerHooks, fn)
+}
+
+// KeepAlive reports whether the connection can be reused for another
+// request once the handler returns
+func (w *Writer) KeepAlive() bool {
+	if w.noBody && w.state >= writerBody {
+		return w.keepAlive
+	}
+	switch w.state {
+	case writerBody:
+		return w.keepAlive && w.bodyWritten == w.contentLength
+	case writerDone:
+		return w.keepAlive
+	default:
+		return false
+	}
+}
+
+// stateError describes a call that isn't allowed in the current state
+func (w *Writer) stateError(action string) error {
+	return fmt.Errorf("%w: can't %s in state %s", ErrWriterState, action, w.state)
+}
+
 // WriteStatusLine writes the HTTP status line for the given status code
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	fmt.Fprint(w.writer, GetStatusLine(statusCode))
-	return nil
+	if w.state != writerStatusLine {
+		return w.stateError("write the status line")
+	}
+	w.state = writerHeaders
+	w.statusCode = statusCode
+	_, err := fmt.Fprint(w.writer, statusLine(w.version, statusCode, StatusText(statusCode)))
+	return err
+}
+
+// WriteStatusLineWithReason writes the HTTP status line with a custom reason phrase
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
+	if w.state != writerStatusLine {
+		return w.stateError("write the status line")
+	}
+	// validates the code and reason
+	if _, err := GetStatusLineWithReason(statusCode, reason); err != nil {
+		return err
+	}
+	w.state = writerHeaders
+	w.statusCode = statusCode
+	_, err := fmt.Fprint(w.writer, statusLine(w.version, statusCode, reason))
+	return err
 }
 
-// WriteHeaders writes the provided HTTP headers to the connection
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	if len(headers) < 1 {
+// WriteHeaders writes the provided HTTP headers to the connection, a 200
+// status line is written first if the handler didn't write one
+func (w *Writer) WriteHeaders(headers *headers.Headers) error {
+	if headers.Len() < 1 {
 		return fmt.Errorf("error: headers is empty")
 	}
+	if w.state == writerStatusLine {
+		if err := w.WriteStatusLine(Successful); err != nil {
+			return err
+		}
+	}
+	if w.state != writerHeaders {
+		return w.stateError("write headers")
+	}
+	for _, fn := range w.headerHooks {
+		fn(headers)
+	}
+
+	// responses to HEAD, 1xx, 204 and 304 never have a body (RFC 9112
+	// section 6.3), whatever their headers say
+	w.noBody = w.method == "HEAD" || w.statusCode < 200 ||
+		w.statusCode == NoContent || w.statusCode == NotModified
+
+	// the connection can only be reused if the handler didn't ask to close
+	// it and the client can tell where the body ends
+	w.state = writerBody
+	framed := false
+	if headers.HasToken("transfer-encoding", "chunked") {
+		w.state = writerChunkedBody
+		framed = true
+		if w.version == "1.0" {
+			// HTTP/1.0 has no chunked encoding, closing the connection
+			// ends the body instead
+			headers.Del("Transfer-Encoding")
+			headers.Del("Content-Length")
+			headers.Del("Trailer")
+			w.closeDelimited = true
+			framed = false
+		}
+	} else if length, err := headers.ContentLength(); err == nil && length >= 0 {
+		w.contentLength = length
+		framed = true
+	}
+	if !framed && !w.noBody {
+		headers.Set("Connection", "close")
+	}
+	w.keepAlive = (framed || w.noBody) && !headers.HasToken("connection", "close")
 
-	for header, val := range headers {
+	for header, val := range headers.All() {
 		_, err := fmt.Fprintf(w.writer, "%v: %v\r\n", header, val)
 		if err != nil {
 			return err
@@ -41,13 +210,57 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	return err
 }
 
-// WriteBody writes the body content to the connection
+// WriteBody writes the body content to the connection. If no headers were
+// written yet, the default ones are sent with p as the whole body
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	return w.writer.Write(p)
+	if w.state == writerStatusLine || w.state == writerHeaders {
+		if err := w.WriteHeaders(GetDefaultHeaders(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	if w.state != writerBody {
+		return 0, w.stateError("write the body")
+	}
+	if w.noBody {
+		return len(p), nil
+	}
+	if w.contentLength >= 0 && w.bodyWritten+int64(len(p)) > w.contentLength {
+		return 0, fmt.Errorf("error: body is longer than Content-Length: %d", w.contentLength)
+	}
+
+	n, err := w.writer.Write(p)
+	w.bodyWritten += int64(n)
+	return n, err
 }
 
-// WriteChunkedBody writes a single chunk in HTTP chunked transfer encoding
+// WriteChunkedBody writes a single chunk in HTTP chunked transfer encoding.
+// If no headers were written yet, the default ones are sent for a chunked body
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.state == writerStatusLine || w.state == writerHeaders {
+		h := GetDefaultHeaders(0)
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		if err := w.WriteHeaders(h); err != nil {
+			return 0, err
+		}
+	}
+	if w.state != writerChunkedBody {
+		return 0, w.stateError("write a chunk")
+	}
+	if w.noBody {
+		return len(p), nil
+	}
+	// an empty chunk would end the body
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if w.closeDelimited {
+		n, err := w.writer.Write(p)
+		w.bodyWritten += int64(n)
+		return n, err
+	}
+
 	chunkSize := len(p)
 
 	nTotal := 0 // total bytes
@@ -65,6 +278,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return nTotal, err
 	}
 	nTotal += n
+	w.bodyWritten += int64(n)
 
 	// Write the trailing CRLF after the chunk data
 	n, err = w.writer.Write([]byte("\r\n"))
@@ -77,6 +291,14 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 
 // WriteChunkedBodyDone writes the final chunk to indicate the end of a chunked HTTP message
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.state != writerChunkedBody {
+		return 0, w.stateError("end the chunked body")
+	}
+	// the message isn't complete until WriteTrailers ends it
+	w.state = writerTrailers
+	if w.closeDelimited || w.noBody {
+		return 0, nil
+	}
 	n, err := w.writer.Write([]byte("0\r\n"))
 	if err != nil {
 		return n, err
@@ -85,8 +307,16 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 }
 
 // WriteTrailers writes HTTP trailer headers after the final chunk
-func (w *Writer) WriteTrailers(h headers.Headers) error {
-	for k, v := range h {
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	if w.state != writerTrailers {
+		return w.stateError("write trailers")
+	}
+	w.state = writerDone
+	if w.closeDelimited || w.noBody {
+		// there is nowhere to put trailers without chunked encoding
+		return nil
+	}
+	for k, v := range h.All() {
 		_, err := fmt.Fprintf(w.writer, "%s: %s\r\n", k, v)
 		if err != nil {
 			return err
@@ -95,3 +325,19 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	_, err := w.writer.Write([]byte("\r\n")) // end of trailers
 	return err
 }
+
+// Finish completes a chunked response the handler left open, writing the
+// final chunk and an empty trailer section as needed. Other responses are
+// left as they are
+func (w *Writer) Finish() error {
+	switch w.state {
+	case writerChunkedBody:
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		fallthrough
+	case writerTrailers:
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/h0dy/tcp-to-http/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterOrder(t *testing.T) {
+	// Test: Status line, headers then body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	assert.False(t, w.Committed())
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	assert.True(t, w.Committed())
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 5\r\n\r\nhello", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Status line written twice
+	err = w.WriteStatusLine(OK)
+	assert.ErrorIs(t, err, ErrWriterState)
+
+	// Test: Headers written twice
+	err = w.WriteHeaders(h)
+	assert.ErrorIs(t, err, ErrWriterState)
+
+	// Test: Body longer than Content-Length
+	_, err = w.WriteBody([]byte("!"))
+	require.Error(t, err)
+
+	// Test: Body first defaults to a 200 with default headers
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, buf.String(), "Content-Length: 2\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\nhi")))
+	assert.True(t, w.KeepAlive())
+
+	// Test: Mixing WriteBody and WriteChunkedBody
+	_, err = w.WriteChunkedBody([]byte("hi"))
+	assert.ErrorIs(t, err, ErrWriterState)
+
+	// Test: Chunked body, done and trailers
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody([]byte("hi"))
+	assert.ErrorIs(t, err, ErrWriterState)
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	err = w.WriteTrailers(headers.NewHeaders())
+	assert.ErrorIs(t, err, ErrWriterState)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", buf.String())
+
+	// Test: Finish ends a chunked body left open, with or without the final chunk
+	for _, done := range []bool{false, true} {
+		buf = &bytes.Buffer{}
+		w = NewWriter(buf)
+		_, err = w.WriteChunkedBody([]byte("abc"))
+		require.NoError(t, err)
+		if done {
+			_, err = w.WriteChunkedBodyDone()
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Finish())
+		assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n3\r\nabc\r\n0\r\n\r\n")), buf.String())
+		assert.True(t, w.KeepAlive())
+	}
+
+	// Test: Finish leaves complete responses alone
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	written := buf.Len()
+	require.NoError(t, w.Finish())
+	assert.Equal(t, written, buf.Len())
+}
+
+func TestWriterHTTP10(t *testing.T) {
+	// Test: Status line carries the request's version
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetVersion("1.0")
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "2")
+	h.Set("Connection", "keep-alive")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "HTTP/1.0 200 OK\r\n")
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked bodies are sent unframed and close the connection
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nhello world", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: SetVersion after the status line has no effect
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	w.SetVersion("1.0")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+}
+
+func TestWriterHeaderOrder(t *testing.T) {
+	// Test: Fields are written in order, repeated ones on their own line
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := headers.NewHeaders()
+	h.Add("Content-Length", "0")
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	h.Add("X-Custom", "x")
+	h.Add("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Length: 0\r\n"+
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\n"+
+		"X-Custom: x\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"\r\n", buf.String())
+}
+
+func TestWriterNoBody(t *testing.T) {
+	// Test: 204 and 304 end with the headers and keep the connection
+	for _, code := range []StatusCode{NoContent, NotModified} {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		require.NoError(t, w.WriteStatusLine(code))
+		h := headers.NewHeaders()
+		h.Set("Date", "Wed, 21 Oct 2026 07:28:00 GMT")
+		require.NoError(t, w.WriteHeaders(h))
+		assert.NotContains(t, buf.String(), "Connection")
+		assert.True(t, w.KeepAlive())
+	}
+
+	// Test: A response to HEAD keeps its headers but drops the body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetMethod("HEAD")
+	h := GetDefaultHeaders(5)
+	require.NoError(t, w.WriteHeaders(h))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 5\r\n\r\n"), buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Same for a chunked response to HEAD
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetMethod("HEAD")
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "Transfer-Encoding: chunked\r\n\r\n"), buf.String())
+	assert.True(t, w.KeepAlive())
+}
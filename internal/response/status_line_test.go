@@ -0,0 +1,32 @@
+package response
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	// Test: Registered status codes
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", GetStatusLine(Successful))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", GetStatusLine(NotFound))
+	assert.Equal(t, "HTTP/1.1 308 Permanent Redirect\r\n", GetStatusLine(PermanentRedirect))
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable\r\n", GetStatusLine(ServiceUnavailable))
+
+	// Test: Unregistered status code has an empty reason phrase
+	assert.Equal(t, "HTTP/1.1 299 \r\n", GetStatusLine(299))
+
+	// Test: Custom reason phrase
+	line, err := GetStatusLineWithReason(NotFound, "Nothing To See Here")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 404 Nothing To See Here\r\n", line)
+
+	// Test: Reason phrase with CRLF
+	_, err = GetStatusLineWithReason(OK, "OK\r\nSet-Cookie: a=b")
+	require.Error(t, err)
+
+	// Test: Status code without 3 digits
+	_, err = GetStatusLineWithReason(42, "Answer")
+	require.Error(t, err)
+}
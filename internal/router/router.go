@@ -0,0 +1,267 @@
+package router
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/h0dy/tcp-to-http/internal/server"
+)
+
+// paramsKey is the context key of the matched path params
+type paramsKey struct{}
+
+// ParamsFromContext returns the path params the router matched for the
+// request the context belongs to, or nil
+func ParamsFromContext(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(paramsKey{}).(map[string]string)
+	return params
+}
+
+// anyMethod marks routes (mounts) that accept every method
+const anyMethod = ""
+
+type segmentKind int
+
+const (
+	segmentLiteral  segmentKind = iota // matches itself
+	segmentParam                       // {name}, matches one segment
+	segmentWildcard                    // {name...} or *, matches the rest of the path
+)
+
+type segment struct {
+	kind  segmentKind
+	value string // literal text or param name
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to handlers by method and path pattern.
+// Patterns are made of literal segments, {name} params matching a single
+// segment and a trailing {name...} (or *) wildcard matching the rest
+type Router struct {
+	routes []route
+
+	// NotFound handles requests matching no pattern, it defaults to a 404
+	NotFound server.Handler
+}
+
+// New returns an empty Router
+func New() *Router {
+	return &Router{
+		NotFound: notFound,
+	}
+}
+
+// Handle registers handler for requests with the given method and pattern,
+// it panics on a malformed pattern like the rest of the setup code would
+func (r *Router) Handle(method, pattern string, handler server.Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	r.routes = append(r.routes, route{
+		method:   method,
+		pattern:  pattern,
+		segments: segments,
+		handler:  handler,
+	})
+}
+
+// Get registers handler for GET requests matching pattern
+func (r *Router) Get(pattern string, handler server.Handler) {
+	r.Handle("GET", pattern, handler)
+}
+
+// Post registers handler for POST requests matching pattern
+func (r *Router) Post(pattern string, handler server.Handler) {
+	r.Handle("POST", pattern, handler)
+}
+
+// Put registers handler for PUT requests matching pattern
+func (r *Router) Put(pattern string, handler server.Handler) {
+	r.Handle("PUT", pattern, handler)
+}
+
+// Delete registers handler for DELETE requests matching pattern
+func (r *Router) Delete(pattern string, handler server.Handler) {
+	r.Handle("DELETE", pattern, handler)
+}
+
+// Mount hands every request under prefix to handler whatever its method,
+// the part of the path after prefix is available as the "*" param
+func (r *Router) Mount(prefix string, handler server.Handler) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	r.Handle(anyMethod, prefix+"/*", handler)
+	if prefix != "" {
+		r.Handle(anyMethod, prefix, handler)
+	}
+}
+
+// Handler returns the server.Handler dispatching to the registered routes
+func (r *Router) Handler() server.Handler {
+	return r.serve
+}
+
+func (r *Router) serve(w *response.Writer, req *request.Request) {
+	path := req.Target.Path
+
+	var best *route
+	var bestParams map[string]string
+	var allowed []string
+	for i := range r.routes {
+		rt := &r.routes[i]
+		params, ok := match(rt.segments, path)
+		if !ok {
+			continue
+		}
+		if rt.method != anyMethod && rt.method != req.RequestLine.Method {
+			if !slices.Contains(allowed, rt.method) {
+				allowed = append(allowed, rt.method)
+			}
+			continue
+		}
+		if best == nil || moreSpecific(rt.segments, best.segments) {
+			best = rt
+			bestParams = params
+		}
+	}
+
+	switch {
+	case best != nil:
+		req = req.WithContext(context.WithValue(req.Context(), paramsKey{}, bestParams))
+		req.PathParams = bestParams
+		best.handler(w, req)
+	case len(allowed) > 0:
+		slices.Sort(allowed)
+		methodNotAllowed(w, allowed)
+	default:
+		r.NotFound(w, req)
+	}
+}
+
+// parsePattern splits a pattern into its segments
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, &PatternError{Pattern: pattern, Reason: "must start with /"}
+	}
+
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch {
+		case part == "*":
+			if !last {
+				return nil, &PatternError{Pattern: pattern, Reason: "wildcard must be the last segment"}
+			}
+			segments = append(segments, segment{kind: segmentWildcard, value: "*"})
+
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}"):
+			if !last {
+				return nil, &PatternError{Pattern: pattern, Reason: "wildcard must be the last segment"}
+			}
+			name := part[1 : len(part)-4]
+			if name == "" {
+				return nil, &PatternError{Pattern: pattern, Reason: "wildcard without a name"}
+			}
+			segments = append(segments, segment{kind: segmentWildcard, value: name})
+
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" || strings.ContainsAny(name, "{}") {
+				return nil, &PatternError{Pattern: pattern, Reason: "invalid param name"}
+			}
+			segments = append(segments, segment{kind: segmentParam, value: name})
+
+		default:
+			if strings.ContainsAny(part, "{}") {
+				return nil, &PatternError{Pattern: pattern, Reason: "braces must wrap a whole segment"}
+			}
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+		}
+	}
+	return segments, nil
+}
+
+// match reports whether path matches the pattern segments and returns the
+// matched params
+func match(segments []segment, path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	rest := path[1:]
+	params := map[string]string{}
+
+	for i, seg := range segments {
+		if seg.kind == segmentWildcard {
+			params[seg.value] = rest
+			return params, true
+		}
+
+		part, next, found := strings.Cut(rest, "/")
+		last := i == len(segments)-1
+		// a non-wildcard pattern must consume the whole path
+		if last == found {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case segmentLiteral:
+			if part != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if part == "" {
+				return nil, false
+			}
+			params[seg.value] = part
+		}
+		rest = next
+	}
+	return params, true
+}
+
+// moreSpecific reports whether pattern a should win over pattern b when both
+// match, literals beat params and params beat wildcards segment by segment
+func moreSpecific(a, b []segment) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].kind != b[i].kind {
+			return a[i].kind < b[i].kind
+		}
+	}
+	return len(a) > len(b)
+}
+
+func notFound(w *response.Writer, _ *request.Request) {
+	w.WriteStatusLine(response.NotFound)
+	body := []byte("404 Not Found\n")
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func methodNotAllowed(w *response.Writer, allowed []string) {
+	w.WriteStatusLine(response.MethodNotAllowed)
+	body := []byte("405 Method Not Allowed\n")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// PatternError describes a malformed route pattern
+type PatternError struct {
+	Pattern string
+	Reason  string
+}
+
+func (e *PatternError) Error() string {
+	return "error: invalid route pattern " + e.Pattern + ": " + e.Reason
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a raw request through h and parses the response it writes
+func serve(t *testing.T, r *Router, raw string) (*http.Response, string) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	r.Handler()(response.NewWriter(buf), req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+// echo writes the route name followed by the matched params
+func echo(name string, params ...string) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, p := range params {
+			body += " " + p + "=" + req.PathParam(p)
+		}
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	r := New()
+	r.Get("/", echo("root"))
+	r.Get("/users", echo("users"))
+	r.Get("/users/{id}", echo("user", "id"))
+	r.Put("/users/{id}", echo("put-user", "id"))
+	r.Get("/users/me", echo("me"))
+	r.Get("/users/{id}/posts/{post}", echo("post", "id", "post"))
+	r.Get("/static/{path...}", echo("static", "path"))
+	r.Mount("/httpbin", echo("proxy", "*"))
+
+	// Test: Literal routes
+	resp, body := serve(t, r, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "root", body)
+	_, body = serve(t, r, "GET /users HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "users", body)
+
+	// Test: Path params
+	_, body = serve(t, r, "GET /users/42 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "user id=42", body)
+	_, body = serve(t, r, "GET /users/42/posts/7 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "post id=42 post=7", body)
+
+	// Test: Literal segment wins over a param
+	_, body = serve(t, r, "GET /users/me HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "me", body)
+
+	// Test: Query string is ignored when matching
+	_, body = serve(t, r, "GET /users/42?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "user id=42", body)
+
+	// Test: Path is decoded before matching
+	_, body = serve(t, r, "GET /users/4%32 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "user id=42", body)
+	_, body = serve(t, r, "GET /users/./me HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "me", body)
+
+	// Test: Method picks the route
+	_, body = serve(t, r, "PUT /users/42 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+	assert.Equal(t, "put-user id=42", body)
+
+	// Test: Wildcards
+	_, body = serve(t, r, "GET /static/css/site.css HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "static path=css/site.css", body)
+
+	// Test: Mounts accept any method
+	_, body = serve(t, r, "POST /httpbin/anything/1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+	assert.Equal(t, "proxy *=anything/1", body)
+	_, body = serve(t, r, "GET /httpbin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "proxy *=", body)
+
+	// Test: Unknown path
+	resp, _ = serve(t, r, "GET /nope HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = serve(t, r, "GET /users/42/extra HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Test: Known path, wrong method
+	resp, _ = serve(t, r, "DELETE /users/42 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, PUT", resp.Header.Get("Allow"))
+
+	// Test: Params are on the request context
+	r.Get("/ctx/{id}", func(w *response.Writer, req *request.Request) {
+		w.WriteBody([]byte(ParamsFromContext(req.Context())["id"]))
+	})
+	_, body = serve(t, r, "GET /ctx/9 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "9", body)
+
+	// Test: Custom NotFound handler
+	r.NotFound = echo("fallback")
+	_, body = serve(t, r, "GET /nope HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "fallback", body)
+}
+
+func TestParsePattern(t *testing.T) {
+	// Test: Valid patterns
+	for _, pattern := range []string{"/", "/a/b", "/a/{id}", "/a/{rest...}", "/a/*"} {
+		_, err := parsePattern(pattern)
+		require.NoError(t, err, pattern)
+	}
+
+	// Test: Invalid patterns
+	for _, pattern := range []string{"", "a/b", "/a/*/b", "/{rest...}/b", "/a/{}", "/a/x{id}"} {
+		_, err := parsePattern(pattern)
+		require.Error(t, err, pattern)
+	}
+}
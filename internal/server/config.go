@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
+
+	"github.com/h0dy/tcp-to-http/internal/headers"
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+)
+
+// Handler processes an HTTP request
+type Handler func(w *response.Writer, req *request.Request)
+
+// PanicHandler is called with the recovered value when a Handler panics.
+// It may still write a response if w isn't committed, the connection is
+// closed afterwards either way
+type PanicHandler func(w *response.Writer, req *request.Request, v any)
+
+// Logger is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// ConnState is the state of a connection, reported to Config.ConnState
+type ConnState int
+
+const (
+	StateNew    ConnState = iota // just accepted, waiting for its first request
+	StateActive                  // reading a request or running the handler
+	StateIdle                    // waiting for the next request on a keep-alive connection
+	StateClosed                  // closed, reported once
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Timeouts bounds how long each step of serving a connection may take, they
+// are applied as conn deadlines and a zero field means no timeout
+type Timeouts struct {
+	ReadHeader time.Duration // from the first byte of a request to the end of its headers
+	ReadBody   time.Duration // reading the body, counted from the end of the headers
+	Write      time.Duration // writing the response, counted from the end of the headers
+	Idle       time.Duration // waiting for the next request on a keep-alive connection
+	Request    time.Duration // deadline of the request context, counted from the end of the headers
+}
+
+// DefaultTimeouts returns the timeouts of DefaultConfig
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		ReadHeader: 10 * time.Second,
+		ReadBody:   5 * time.Minute,
+		Write:      5 * time.Minute,
+		Idle:       2 * time.Minute,
+	}
+}
+
+// Config describes how a Server listens and serves. Start from DefaultConfig,
+// the zero value has no timeouts and no parse limits
+type Config struct {
+	// Addr is the TCP address ListenAndServe listens on, e.g.
+	// "127.0.0.1:8080", it defaults to ":http" (":https" with TLS).
+	// "unix:/path/to/socket" listens on a Unix domain socket instead
+	Addr string
+
+	// SocketMode sets the permissions of the socket file when Addr is a
+	// Unix socket, zero keeps the ones given by the umask
+	SocketMode os.FileMode
+
+	// Handler serves every request
+	Handler Handler
+
+	// Timeouts bounds reading requests, writing responses and idling
+	Timeouts Timeouts
+
+	// Limits bounds the request-line, the header section (max header
+	// bytes and count) and the body
+	Limits request.Limits
+
+	// ObsFold says what to do with obsolete line folding in request
+	// headers, they are rejected with a 400 by default
+	ObsFold headers.FoldMode
+
+	// TLSConfig makes the server speak HTTPS when set
+	TLSConfig *tls.Config
+
+	// CertFile and KeyFile hold a PEM certificate (chain) and its key, they
+	// also make the server speak HTTPS. The files are reloaded when they
+	// change or on Server.ReloadCertificates
+	CertFile string
+	KeyFile  string
+
+	// Logger receives the server's errors, it defaults to log.Default()
+	Logger Logger
+
+	// OnError is called with the error that made a listener stop accepting.
+	// Transient errors (e.g. too many open files) are retried with a
+	// backoff and never reach it
+	OnError func(error)
+
+	// OnPanic replaces the default panic handling, which logs the stack and
+	// sends a 500 if the response isn't committed yet
+	OnPanic PanicHandler
+
+	// ConnState is called every time a connection changes state
+	ConnState func(conn net.Conn, state ConnState)
+}
+
+// DefaultConfig returns a Config with the default timeouts and limits
+func DefaultConfig() Config {
+	return Config{
+		Timeouts: DefaultTimeouts(),
+		Limits:   request.DefaultLimits(),
+	}
+}
+
+// Option configures the server started by Serve
+type Option func(*Config)
+
+// WithLimits sets the parse limits applied to every request
+func WithLimits(limits request.Limits) Option {
+	return func(c *Config) {
+		c.Limits = limits
+	}
+}
+
+// WithObsFold sets how folded request header lines are handled
+func WithObsFold(mode headers.FoldMode) Option {
+	return func(c *Config) {
+		c.ObsFold = mode
+	}
+}
+
+// WithTimeouts sets the read, write and idle timeouts of every connection
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(c *Config) {
+		c.Timeouts = timeouts
+	}
+}
+
+// WithLogger sets where the server logs, it defaults to log.Default()
+func WithLogger(logger Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithErrorHandler sets a callback for the error that made the server stop
+// accepting connections, see Config.OnError
+func WithErrorHandler(onError func(error)) Option {
+	return func(c *Config) {
+		c.OnError = onError
+	}
+}
+
+// WithPanicHandler replaces the default panic handling, see Config.OnPanic
+func WithPanicHandler(onPanic PanicHandler) Option {
+	return func(c *Config) {
+		c.OnPanic = onPanic
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrConnClosed is the cause of a request context cancelled because the
+// client closed the connection
+var ErrConnClosed = errors.New("error: connection closed by client")
+
+// aLongTimeAgo is a deadline in the past, it makes a pending Read return
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader reads from a connection for the request parser. While a
+// handler runs and the request body is read, it keeps a 1 byte read pending
+// in the background to notice the client going away
+type connReader struct {
+	conn net.Conn
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inRead   bool        // the background read is pending
+	hasByte  bool        // the background read got byteBuf[0]
+	byteBuf  [1]byte     // byte read in the background, not yet returned
+	watching bool        // a background read may be started
+	onClose  func(error) // called if the background read fails
+	deadline time.Time   // read deadline to restore after an abort
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+// Read returns the byte read in the background if any, otherwise it reads
+// from the connection once the background read is stopped
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	cr.abortLocked()
+	if cr.hasByte {
+		cr.hasByte = false
+		cr.mu.Unlock()
+		if len(p) == 0 {
+			return 0, nil
+		}
+		p[0] = cr.byteBuf[0]
+		return 1, nil
+	}
+	cr.mu.Unlock()
+	return cr.conn.Read(p)
+}
+
+// SetReadDeadline sets the read deadline of the connection, remembering it
+// for when a background read is stopped
+func (cr *connReader) SetReadDeadline(t time.Time) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.abortLocked()
+	cr.deadline = t
+	cr.conn.SetReadDeadline(t)
+}
+
+// watch allows background reads until unwatch, onClose is called with
+// ErrConnClosed if the client closes the connection in the meantime
+func (cr *connReader) watch(onClose func(error)) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.watching = true
+	cr.onClose = onClose
+}
+
+// unwatch stops the pending background read and doesn't allow new ones
+func (cr *connReader) unwatch() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.abortLocked()
+	cr.watching = false
+	cr.onClose = nil
+}
+
+// startBackgroundRead starts a read of a single byte if the connection is
+// watched, no other read is pending and no byte is waiting to be returned
+func (cr *connReader) startBackgroundRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.watching || cr.inRead || cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	// a timeout is either an abort or the read deadline, the client is
+	// still there as far as we know
+	var netErr net.Error
+	timeout := errors.As(err, &netErr) && netErr.Timeout()
+	if err != nil && !timeout && cr.onClose != nil {
+		cr.onClose(ErrConnClosed)
+	}
+	cr.inRead = false
+	cr.cond.Broadcast()
+}
+
+// abortLocked stops the pending background read, if any, and waits for it
+// to return. cr.mu must be held
+func (cr *connReader) abortLocked() {
+	if !cr.inRead {
+		return
+	}
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(cr.deadline)
+}
+
+// bodyWatcher starts a background read once the request body has been read
+// to the end, the connection is idle from then until the next request
+type bodyWatcher struct {
+	io.ReadCloser
+	cr *connReader
+}
+
+func (b *bodyWatcher) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.cr.startBackgroundRead()
+	}
+	return n, err
+}
@@ -1,78 +1,587 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/h0dy/tcp-to-http/internal/headers"
 	"github.com/h0dy/tcp-to-http/internal/request"
 	"github.com/h0dy/tcp-to-http/internal/response"
 )
 
+// bounds of the backoff between retries of a failed Accept
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// shutdownPollInterval is how often Shutdown checks for finished connections
+const shutdownPollInterval = 50 * time.Millisecond
+
+// maxDrainBytes bounds the unread body discarded after the handler returns
+// to reuse the connection, closing it is cheaper past that
+const maxDrainBytes = 256 << 10
+
+// ErrServerClosed is returned by Serve and ListenAndServe once the server
+// is closed or shut down
+var ErrServerClosed = errors.New("error: server closed")
+
+// deadline returns the deadline for a timeout starting now, or the zero time
+// (no deadline) for a zero timeout
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
 // Server is an HTTP 1.1 server
 type Server struct {
-	closed   atomic.Bool
-	listener net.Listener
-	port     int
-	handler  Handler
+	cfg    Config
+	closed atomic.Bool
+
+	ctx    context.Context // parent of every request context
+	cancel context.CancelCauseFunc
+
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config   // nil for a plaintext server
+	tlsErr    error         // why tlsConfig couldn't be built
+	certs     *CertReloader // set when serving Config.CertFile
+
+	lastConnID atomic.Uint64 // ID of the last accepted connection
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{} // listeners being served
+	conns     map[net.Conn]ConnState    // open connections
+}
+
+// Middleware wraps a Handler to run code around it
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with middlewares, the first one being the outermost
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// New returns a Server for cfg, it starts serving on ListenAndServe or Serve
+func New(cfg Config) *Server {
+	s := &Server{
+		cfg:       cfg,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]ConnState{},
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	if s.cfg.Logger == nil {
+		s.cfg.Logger = log.Default()
+	}
+	if s.cfg.OnPanic == nil {
+		s.cfg.OnPanic = s.defaultPanicHandler
+	}
+	return s
+}
+
+// Serve starts a TCP server on the given port with the provided handler,
+// serving in the background with DefaultConfig changed by opts
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	cfg := DefaultConfig()
+	cfg.Addr = fmt.Sprintf(":%v", port)
+	cfg.Handler = handler
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s := New(cfg)
+
+	listen, err := s.listen()
+	if err != nil {
+		return nil, err
+	}
+	go s.serve(listen)
+
+	return s, nil
+}
+
+// ListenAndServe listens on Config.Addr and serves until the server is closed,
+// it always returns a non-nil error
+func (s *Server) ListenAndServe() error {
+	listen, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.serve(listen)
+}
+
+// Serve accepts connections on l until the server is closed or Accept fails
+// with a permanent error, it always returns a non-nil error and closes l
+func (s *Server) Serve(l net.Listener) error {
+	tlsConfig, err := s.initTLS()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	if err := s.trackListener(l); err != nil {
+		l.Close()
+		return err
+	}
+	return s.serve(l)
 }
 
-// Handler processes an HTTP request
-type Handler func(w *response.Writer, req *request.Request)
+// Addr returns the address of one of the listeners being served, or nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-// Serve starts a TCP server on the given port with the provided handler
-func Serve(port int, handler Handler) (*Server, error) {
-	listen, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	for l := range s.listeners {
+		return l.Addr()
+	}
+	return nil
+}
+
+// listen opens and tracks the listener for Config.Addr
+func (s *Server) listen() (net.Listener, error) {
+	if s.closed.Load() {
+		return nil, ErrServerClosed
+	}
+	tlsConfig, err := s.initTLS()
 	if err != nil {
-		return nil, fmt.Errorf("error: failed to bind to port: %v", port)
+		return nil, err
 	}
-	server := &Server{
-		port:     port,
-		listener: listen,
-		handler:  handler,
+
+	addr := s.cfg.Addr
+	if addr == "" {
+		addr = ":http"
+		if tlsConfig != nil {
+			addr = ":https"
+		}
+	}
+	var listen net.Listener
+	if path, ok := unixSocketPath(addr); ok {
+		listen, err = listenUnix(path, s.cfg.SocketMode)
+	} else {
+		listen, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to listen on %v: %w", addr, err)
+	}
+	if tlsConfig != nil {
+		listen = tls.NewListener(listen, tlsConfig)
+	}
+	if err := s.trackListener(listen); err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return listen, nil
+}
+
+// trackListener records l so Close and Shutdown can close it
+func (s *Server) trackListener(l net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed.Load() {
+		return ErrServerClosed
 	}
+	s.listeners[l] = struct{}{}
+	return nil
+}
 
-	go server.listen()
+// closeListeners closes every listener being served
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return server, nil
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
 }
 
-// s.Close() closes the connection of the server
+// s.Close() stops the server right away, closing the listeners and every
+// open connection including those with a response in flight
 func (s *Server) Close() error {
 	s.closed.Store(true)
-	return s.listener.Close()
+	s.cancel(ErrServerClosed)
+	err := s.closeListeners()
+	s.closeConns(false)
+	return err
+}
+
+// Shutdown stops accepting connections, closes idle keep-alive connections
+// and waits for active ones to finish their response. The requests in
+// flight keep their contexts until ctx expires, then the contexts are
+// cancelled, the remaining connections are closed and ctx's error is
+// returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	err := s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeConns(true) == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.cancel(ErrServerClosed)
+			s.closeConns(false)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeConns closes the new and idle connections, or all of them if
+// onlyIdle is false, and returns how many are left open
+func (s *Server) closeConns(onlyIdle bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	left := 0
+	for conn, state := range s.conns {
+		if onlyIdle && state == StateActive {
+			left++
+			continue
+		}
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return left
 }
 
-// s.listen() starts listing and accepts incoming requests
-func (s *Server) listen() {
-	fmt.Printf("serving on port: %v\n", s.port)
+// setConnState records the state of conn, forgetting it once closed, and
+// reports it to Config.ConnState
+func (s *Server) setConnState(conn net.Conn, state ConnState) {
+	// report first so Shutdown doesn't return before the closed hook ran
+	if s.cfg.ConnState != nil {
+		s.cfg.ConnState(conn, state)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == StateClosed {
+		delete(s.conns, conn)
+		return
+	}
+	s.conns[conn] = state
+}
 
-	for !s.closed.Load() {
-		conn, err := s.listener.Accept()
+// serve accepts incoming connections on l, retrying transient errors
+func (s *Server) serve(l net.Listener) error {
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+	s.cfg.Logger.Printf("serving on: %v", l.Addr())
+
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
 		if err != nil {
 			if s.closed.Load() {
-				return
+				return ErrServerClosed
 			}
-			log.Fatalf("error: couldn't accept connection: %v", err.Error())
-			continue
+			if isTemporary(err) {
+				backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+				s.cfg.Logger.Printf("error: couldn't accept connection: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			s.cfg.Logger.Printf("error: stopped accepting connections: %v", err)
+			if s.cfg.OnError != nil {
+				s.cfg.OnError(err)
+			}
+			return err
 		}
+		backoff = 0
+		s.setConnState(conn, StateNew)
 		go s.handle(conn)
 	}
 }
 
-// handle handles incoming connection
+// isTemporary reports whether a failed Accept is worth retrying, e.g. when
+// the process ran out of file descriptors for a moment
+func isTemporary(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle serves requests on conn until either side asks to close it,
+// the idle timeout fires or the server is closed
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	defer func() {
+		conn.Close()
+		s.setConnState(conn, StateClosed)
+	}()
 
-	w := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		w.WriteStatusLine(response.ClientError)
-		body := fmt.Appendf(nil, "error parsing request: %v", err)
-		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-		w.WriteBody(body)
+	// finish the TLS handshake up front so its state can be put on requests
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(deadline(s.cfg.Timeouts.ReadHeader))
+		if err := tlsConn.Handshake(); err != nil {
+			s.cfg.Logger.Printf("error: TLS handshake with %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	connID := s.lastConnID.Add(1)
+	remote := remoteAddr(conn)
+	// the connection's context is cancelled when handle returns, which
+	// also covers the client going away
+	connCtx, cancelConn := context.WithCancelCause(s.ctx)
+	defer cancelConn(ErrConnClosed)
+
+	cr := newConnReader(conn)
+	parser := request.NewParser(cr)
+	parser.Limits = s.cfg.Limits
+	parser.ObsFold = s.cfg.ObsFold
+	for seq := 1; ; seq++ {
+		if s.closed.Load() {
+			return
+		}
+		// wait for the next request under the idle timeout, then give
+		// the client ReadHeader to send the rest of the headers
+		cr.SetReadDeadline(deadline(s.cfg.Timeouts.Idle))
+		if err := parser.Wait(); err != nil {
+			return
+		}
+		receivedAt := time.Now()
+		s.setConnState(conn, StateActive)
+		cr.SetReadDeadline(deadline(s.cfg.Timeouts.ReadHeader))
+
+		req, err := parser.ReadRequest()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				conn.SetWriteDeadline(deadline(s.cfg.Timeouts.Write))
+				s.writeError(response.NewWriter(conn), response.RequestTimeout, "")
+				return
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+				// the client went away in the middle of the request
+				return
+			}
+			// the details are for the log, they may reveal internals
+			s.cfg.Logger.Printf("error: parsing request from %v: %v", remote, err)
+			s.writeError(response.NewWriter(conn), statusForParseError(err), clientReason(err))
+			return
+		}
+		req.TLS = tlsState
+		req.RemoteAddr = remote
+		req.LocalAddr = conn.LocalAddr()
+		req.ConnID = connID
+		req.Seq = seq
+		req.ReceivedAt = receivedAt
+		cr.SetReadDeadline(deadline(s.cfg.Timeouts.ReadBody))
+		conn.SetWriteDeadline(deadline(s.cfg.Timeouts.Write))
+
+		w := response.NewWriter(conn)
+		w.SetVersion(req.RequestLine.HttpVersion)
+		w.SetMethod(req.RequestLine.Method)
+		w.OnWriteHeaders(func(h *headers.Headers) {
+			// tell the client not to send another request during shutdown
+			if s.closed.Load() {
+				h.Set("Connection", "close")
+				return
+			}
+			// tell the client the connection closes as it asked
+			if !req.KeepAlive() {
+				h.Set("Connection", "close")
+				return
+			}
+			// HTTP/1.0 clients only keep the connection if told so
+			if req.RequestLine.HttpVersion == "1.0" && !h.HasToken("connection", "close") {
+				h.Set("Connection", "keep-alive")
+			}
+		})
+		ctx, cancel := s.requestContext(connCtx, cr, req)
+		req = req.WithContext(ctx)
+		ok := s.runHandler(w, req)
+		cr.unwatch()
+		cancel()
+		if !ok {
+			// the handler panicked, its state (and the body) is unknown
+			return
+		}
+		if !w.Committed() {
+			if err := req.BodyErr(); err != nil {
+				// the handler gave up on a body that failed to parse
+				s.cfg.Logger.Printf("error: parsing request body from %v: %v", remote, err)
+				s.writeError(w, statusForParseError(err), clientReason(err))
+				return
+			}
+			// the handler didn't write anything, send an empty 200
+			w.WriteBody(nil)
+		}
+		// end a chunked body the handler left open, e.g. without trailers
+		if err := w.Finish(); err != nil {
+			return
+		}
+
+		// discard whatever the handler left of the body so the next
+		// request can be parsed
+		if !drainBody(req.Body) {
+			return
+		}
+		if !req.KeepAlive() || !w.KeepAlive() || s.closed.Load() {
+			return
+		}
+		s.setConnState(conn, StateIdle)
+	}
+}
+
+// drainBody discards the rest of body, up to maxDrainBytes. It reports
+// whether the body was read to its end and the connection can be reused
+func drainBody(body io.ReadCloser) bool {
+	_, err := io.CopyN(io.Discard, body, maxDrainBytes+1)
+	switch {
+	case err == nil:
+		// there is more than maxDrainBytes left
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, request.ErrBodyReadAfterClose):
+		// the handler may have closed the body, which discarded it already
+		return body.Close() == nil
+	default:
+		return false
+	}
+}
+
+// requestContext returns the context of req, it is cancelled when the
+// client closes the connection (noticed once the body has been read), when
+// the server shuts down or after Timeouts.Request
+func (s *Server) requestContext(connCtx context.Context, cr *connReader, req *request.Request) (context.Context, context.CancelFunc) {
+	ctx, cancelCause := context.WithCancelCause(connCtx)
+	cancel := func() { cancelCause(context.Canceled) }
+	if s.cfg.Timeouts.Request > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.cfg.Timeouts.Request)
+		cancel = func() {
+			cancelTimeout()
+			cancelCause(context.Canceled)
+		}
 	}
 
-	s.handler(w, req)
+	cr.watch(cancelCause)
+	if req.Body == request.NoBody {
+		cr.startBackgroundRead()
+	} else {
+		req.Body = &bodyWatcher{ReadCloser: req.Body, cr: cr}
+	}
+	return ctx, cancel
+}
+
+// runHandler runs the handler, recovering a panic so it only takes down
+// this connection. It reports whether the handler returned normally
+func (s *Server) runHandler(w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.cfg.OnPanic(w, req, v)
+			ok = false
+		}
+	}()
+	s.cfg.Handler(w, req)
+	return true
+}
+
+// defaultPanicHandler logs the panic with its stack and sends a 500 if the
+// response hasn't been committed yet
+func (s *Server) defaultPanicHandler(w *response.Writer, req *request.Request, v any) {
+	s.cfg.Logger.Printf("panic serving %s %s: %v\n%s",
+		req.RequestLine.Method, req.RequestLine.RequestTarget, v, debug.Stack())
+	if w.Committed() {
+		return
+	}
+	w.WriteStatusLine(response.InternalServerError)
+	body := []byte("500 Internal Server Error\n")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Connection", "close")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// writeError sends a response for a request that couldn't be served and
+// asks the client to close the connection, the body is the status text
+// followed by reason if there is one
+func (s *Server) writeError(w *response.Writer, statusCode response.StatusCode, reason string) {
+	w.WriteStatusLine(statusCode)
+	text := fmt.Sprintf("%d %s", statusCode, response.StatusText(statusCode))
+	if reason != "" {
+		text += ": " + reason
+	}
+	body := []byte(text + "\n")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Connection", "close")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// clientReason returns the part of a parse error meant for the client: why
+// the target or a field line is invalid. It is "" for other errors, whose
+// details are only logged
+func clientReason(err error) string {
+	var targetErr *request.TargetError
+	if errors.As(err, &targetErr) {
+		return "invalid request target: " + targetErr.Reason
+	}
+	var fieldErr *headers.FieldError
+	if errors.As(err, &fieldErr) {
+		return "invalid header field: " + fieldErr.Reason
+	}
+	return ""
+}
+
+// statusForParseError picks the response status for a request that failed to parse
+func statusForParseError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.URITooLong
+	case errors.Is(err, request.ErrHeadersTooLarge), errors.Is(err, request.ErrTooManyHeaders):
+		return response.RequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.ContentTooLarge
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.HTTPVersionNotSupported
+	case errors.Is(err, request.ErrUnsupportedTransferCoding):
+		return response.NotImplemented
+	case errors.Is(err, request.ErrInvalidMethod):
+		// a malformed request-line, 405 is for a valid method the
+		// target doesn't allow and needs an Allow header
+		return response.BadRequest
+	default:
+		return response.ClientError
+	}
 }
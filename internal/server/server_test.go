@@ -0,0 +1,1001 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/h0dy/tcp-to-http/internal/headers"
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func okHandler(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.Successful)
+	body := []byte(req.RequestLine.RequestTarget)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Several requests on the same connection
+	for _, target := range []string{"/one", "/two", "/three"} {
+		_, err = io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, target, string(body))
+		assert.False(t, resp.Close)
+	}
+
+	// Test: Connection: close from the client ends the connection
+	_, err = io.WriteString(conn, "GET /last HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.True(t, resp.Close)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestBodyParseError(t *testing.T) {
+	// the handler gives up on a body it can't read, without responding
+	handler := func(w *response.Writer, req *request.Request) {
+		if _, err := req.ReadBody(); err != nil {
+			return
+		}
+		okHandler(w, req)
+	}
+	s, err := Serve(0, handler, WithLimits(request.Limits{MaxBodyBytes: 4}))
+	require.NoError(t, err)
+	defer s.Close()
+	// ReadBody has a limit of its own
+	readLimited, err := Serve(0, handler, WithLimits(request.Limits{MaxReadBodyBytes: 4}))
+	require.NoError(t, err)
+	defer readLimited.Close()
+
+	tests := []struct {
+		name   string
+		server *Server
+		body   string
+		status int
+	}{
+		{"chunked body over the limit", s, "a\r\n0123456789\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"malformed chunk", s, "zz\r\n", http.StatusBadRequest},
+		{"chunked body over the ReadBody limit", readLimited, "a\r\n0123456789\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		// Test: The parse error is answered instead of an empty 200
+		conn, err := net.Dial("tcp", tt.server.Addr().String())
+		require.NoError(t, err)
+		_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"+tt.body)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err, tt.name)
+		conn.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, tt.name)
+		assert.True(t, resp.Close, tt.name)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	s, err := Serve(0, okHandler, WithLimits(request.Limits{
+		MaxRequestLineBytes: 64,
+		MaxHeaderBytes:      128,
+		MaxHeaderCount:      4,
+		MaxBodyBytes:        16,
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		req    string
+		status int
+	}{
+		{"request-line too long", "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: localhost\r\n\r\n", http.StatusRequestURITooLong},
+		{"headers too large", "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 200) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"too many headers", "GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\nE: 5\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"body too large", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 17\r\n\r\n", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = io.WriteString(conn, tt.req)
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+	addr := s.Addr().String()
+
+	// an idle keep-alive connection
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	idleReader := bufio.NewReader(idle)
+	_, err = io.WriteString(idle, "GET /idle HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(idleReader, nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// a connection with a response in flight
+	active, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer active.Close()
+	_, err = io.WriteString(active, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// Test: Idle connection is closed
+	_, err = idleReader.ReadByte()
+	assert.Error(t, err)
+
+	// Test: New connections are refused
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// Test: Shutdown waits for the active response
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with a response in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	resp, err = http.ReadResponse(bufio.NewReader(active), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "/slow", string(body))
+	assert.True(t, resp.Close)
+	require.NoError(t, <-done)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	// Test: Expired context force-closes the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestTimeouts(t *testing.T) {
+	s, err := Serve(0, okHandler, WithTimeouts(Timeouts{
+		ReadHeader: 100 * time.Millisecond,
+		Idle:       300 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	// Test: Slow headers get a 408
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: loc")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.True(t, resp.Close)
+
+	// Test: Idle time doesn't count against the header timeout
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(150 * time.Millisecond)
+	_, err = io.WriteString(conn, "GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// Test: Idle keep-alive connection is closed
+	start := time.Now()
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// flakyListener fails Accept with the queued errors before using the real listener
+type flakyListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+type bufLogger struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (l *bufLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.buf, format+"\n", v...)
+}
+
+func (l *bufLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestAcceptErrors(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	l := &flakyListener{Listener: inner, errs: []error{emfile, emfile, emfile}}
+	logger := &bufLogger{}
+	stopped := make(chan error, 1)
+	returned := make(chan error, 1)
+	cfg := DefaultConfig()
+	cfg.Handler = okHandler
+	cfg.Logger = logger
+	cfg.OnError = func(err error) {
+		stopped <- err
+	}
+	s := New(cfg)
+	go func() {
+		returned <- s.Serve(l)
+	}()
+	defer s.Close()
+
+	// Test: Transient errors are retried
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /after HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, strings.Count(logger.String(), "too many open files"))
+
+	// Test: Permanent errors reach the error handler
+	permanent := errors.New("listener broke")
+	l.mu.Lock()
+	l.errs = []error{permanent}
+	l.mu.Unlock()
+	// the pending Accept only sees the new error after one more connection
+	conn2, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	select {
+	case err := <-stopped:
+		assert.ErrorIs(t, err, permanent)
+	case <-time.After(2 * time.Second):
+		t.Fatal("error handler wasn't called")
+	}
+	assert.ErrorIs(t, <-returned, permanent)
+}
+
+func TestConfig(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	cfg := DefaultConfig()
+	cfg.Handler = okHandler
+	cfg.ConnState = func(_ net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	}
+	s := New(cfg)
+
+	// Test: Serve on an injected listener bound to loopback only
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	returned := make(chan error, 1)
+	go func() {
+		returned <- s.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "GET /cfg HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "/cfg", string(body))
+	conn.Close()
+
+	// Test: Shutdown makes Serve return ErrServerClosed
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-returned, ErrServerClosed)
+
+	// Test: Connection hooks see every state
+	mu.Lock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateClosed}, states)
+	mu.Unlock()
+
+	// Test: Serving after shutdown is refused
+	assert.ErrorIs(t, s.ListenAndServe(), ErrServerClosed)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	panicky := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/late" {
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			w.WriteBody([]byte("part"))
+		}
+		panic("boom")
+	}
+	logger := &bufLogger{}
+	s, err := Serve(0, panicky, WithLogger(logger))
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	// Test: Panic before committing gives a 500 and closes the connection
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.True(t, resp.Close)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Contains(t, logger.String(), "panic serving GET /: boom")
+	assert.Contains(t, logger.String(), "goroutine")
+
+	// Test: Panic after committing aborts the connection
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Server keeps serving other connections
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestCustomPanicHandler(t *testing.T) {
+	recovered := make(chan any, 1)
+	s, err := Serve(0, func(*response.Writer, *request.Request) {
+		panic("custom")
+	}, WithPanicHandler(func(w *response.Writer, _ *request.Request, v any) {
+		recovered <- v
+		w.WriteStatusLine(response.ServiceUnavailable)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Custom panic handler writes the response
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "custom", <-recovered)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := t.TempDir() + "/http.sock"
+	network := func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RemoteAddr.Network())
+		w.WriteBody(body)
+	}
+
+	// Test: A stale socket file is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+
+	cfg := DefaultConfig()
+	cfg.Addr = "unix:" + path
+	cfg.SocketMode = 0o660
+	cfg.Handler = network
+	s := New(cfg)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ListenAndServe()
+	}()
+	require.Eventually(t, func() bool { return s.Addr() != nil }, time.Second, 5*time.Millisecond)
+
+	// Test: The socket file gets SocketMode
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket, info.Mode().Type())
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+
+	// Test: Requests over the socket have a unix remote address
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "unix", string(body))
+
+	// Test: A socket in use isn't taken over
+	_, err = listenUnix(path, 0)
+	assert.Error(t, err)
+
+	// Test: A path that isn't a socket is left alone
+	file := t.TempDir() + "/file"
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	_, err = listenUnix(file, 0)
+	assert.Error(t, err)
+	_, err = os.Stat(file)
+	assert.NoError(t, err)
+
+	// Test: Shutdown removes the socket file
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-serveErr, ErrServerClosed)
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRemoteAddr(t *testing.T) {
+	remote := make(chan net.Addr, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		remote <- req.RemoteAddr
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: TCP requests carry the client's address
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	addr := <-remote
+	assert.Equal(t, "tcp", addr.Network())
+	assert.Equal(t, conn.LocalAddr().String(), addr.String())
+}
+
+func TestConnMetadata(t *testing.T) {
+	reqs := make(chan *request.Request, 4)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		reqs <- req
+		w.WriteBody(nil)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	send := func(conn net.Conn, reader *bufio.Reader) *request.Request {
+		_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return <-reqs
+	}
+
+	// Test: Requests on a keep-alive connection share its ID and count up
+	before := time.Now()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	first := send(conn, reader)
+	second := send(conn, reader)
+	assert.Equal(t, first.ConnID, second.ConnID)
+	assert.Equal(t, 1, first.Seq)
+	assert.Equal(t, 2, second.Seq)
+	assert.Equal(t, conn.LocalAddr().String(), first.RemoteAddr.String())
+	assert.Equal(t, conn.RemoteAddr().String(), first.LocalAddr.String())
+	assert.False(t, first.ReceivedAt.Before(before))
+	assert.False(t, second.ReceivedAt.Before(first.ReceivedAt))
+
+	// Test: Another connection gets another ID and starts over
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	other := send(conn2, bufio.NewReader(conn2))
+	assert.NotEqual(t, first.ConnID, other.ConnID)
+	assert.Equal(t, 1, other.Seq)
+}
+
+func TestRequestContext(t *testing.T) {
+	// handler reports the cause its context was cancelled with
+	causes := make(chan error, 1)
+	started := make(chan struct{}, 1)
+	waitCancel := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/body" {
+			req.ReadBody()
+		}
+		started <- struct{}{}
+		<-req.Context().Done()
+		causes <- context.Cause(req.Context())
+	}
+	cfg := DefaultConfig()
+	cfg.Handler = waitCancel
+	s := New(cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+
+	// Test: Client closing the connection cancels the context
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	conn.Close()
+	assert.ErrorIs(t, <-causes, ErrConnClosed)
+
+	// Test: Same once the body has been read
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "POST /body HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	<-started
+	conn.Close()
+	assert.ErrorIs(t, <-causes, ErrConnClosed)
+
+	// Test: Shutdown leaves the context alone until its own ctx expires
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+	select {
+	case <-causes:
+		t.Fatal("Shutdown cancelled a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.ErrorIs(t, <-shutdown, context.DeadlineExceeded)
+	assert.ErrorIs(t, <-causes, ErrServerClosed)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	timeouts := DefaultTimeouts()
+	timeouts.Request = 20 * time.Millisecond
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		w.WriteStatusLine(response.ServiceUnavailable)
+		body := []byte(req.Context().Err().Error())
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, WithTimeouts(timeouts))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The context expires after Timeouts.Request, the connection
+	// can still be reused
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for range 2 {
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, context.DeadlineExceeded.Error(), string(body))
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Requests sent back to back are all answered, in order
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc"+
+		"GET /c HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	for _, target := range []string{"/a", "/b", "/c"} {
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, target, string(body))
+	}
+}
+
+func TestInvalidTarget(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: An invalid target gets a 400 with the reason
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /%zz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "invalid percent-encoding in path")
+}
+
+func TestHTTP10(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/chunked" {
+			w.WriteChunkedBody([]byte("chunked"))
+			w.WriteChunkedBodyDone()
+			w.WriteTrailers(headers.NewHeaders())
+			return
+		}
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	// Test: HTTP/1.0 closes the connection by default
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /a HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.0 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(raw), "\r\n\r\n/a"))
+
+	// Test: HTTP/1.0 keep-alive is honored and confirmed
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two"} {
+		_, err = io.WriteString(conn, "GET "+target+" HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.0", resp.Proto)
+		assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+		assert.Equal(t, target, string(body))
+	}
+
+	// Test: Chunked responses are close-delimited for HTTP/1.0
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /chunked HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+	raw, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.NotContains(t, strings.ToLower(string(raw)), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(string(raw), "\r\n\r\nchunked"))
+
+	// Test: Unknown major version gets a 505
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/2.0\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, resp.StatusCode)
+}
+
+func TestInvalidHost(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: An HTTP/1.1 request without Host gets a 400
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSmuggling(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	status := func(raw string) int {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, raw)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// Test: Transfer-Encoding with Content-Length gets a 400
+	assert.Equal(t, http.StatusBadRequest, status("POST / HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+
+	// Test: Unknown transfer codings get a 501
+	assert.Equal(t, http.StatusNotImplemented, status("POST / HTTP/1.1\r\nHost: localhost\r\n"+
+		"Transfer-Encoding: gzip\r\n\r\n"))
+}
+
+func TestParseErrorStatus(t *testing.T) {
+	limits := request.DefaultLimits()
+	limits.MaxBodyBytes = 10 << 20
+	s, err := Serve(0, okHandler, WithLimits(limits))
+	require.NoError(t, err)
+	defer s.Close()
+
+	tests := []struct {
+		raw    string
+		status int
+	}{
+		{"GET /\r\n\r\n", http.StatusBadRequest},
+		{"get / HTTP/1.1\r\nHost: localhost\r\n\r\n", http.StatusBadRequest},
+		{"GET / HTTP/2.0\r\nHost: localhost\r\n\r\n", http.StatusHTTPVersionNotSupported},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nX\x00: y\r\n\r\n", http.StatusBadRequest},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 99999999999\r\n\r\n", http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_, err = io.WriteString(conn, tc.raw)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err, "%q", tc.raw)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		conn.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, "%q", tc.raw)
+		// the body is the status text and at most a reason, never the
+		// parse error itself
+		assert.True(t, strings.HasPrefix(string(body), fmt.Sprintf("%d %s", tc.status, response.StatusText(response.StatusCode(tc.status)))), string(body))
+		assert.NotContains(t, string(body), "error:")
+		assert.NotContains(t, string(body), "offset")
+	}
+}
+
+func TestClientGoneMidRequest(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: A request cut short by the client gets no response
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: loc")
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestUnreadBodyDrain(t *testing.T) {
+	// the zero Limits have no body limit
+	s, err := Serve(0, okHandler, WithLimits(request.Limits{}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: A small unread body is discarded and the connection reused
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"+
+		"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	for range 2 {
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+	}
+
+	// Test: A large unread body isn't read to its end, the connection is
+	// closed instead
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1073741824\r\n\r\n")
+	require.NoError(t, err)
+	go func() {
+		// more than the server drains, far less than the body
+		chunk := make([]byte, 64<<10)
+		for range 8 {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = io.Copy(io.Discard, reader)
+	var netErr net.Error
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the server kept reading the body")
+}
+
+func TestUnfinishedChunkedResponse(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.WriteChunkedBody([]byte("abc"))
+		if req.RequestLine.RequestTarget == "/done" {
+			w.WriteChunkedBodyDone()
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The server ends chunked bodies the handler left open and
+	// keeps the connection
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, target := range []string{"/open", "/done", "/open"} {
+		_, err = io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, target)
+		assert.Equal(t, "abc", string(body))
+		assert.False(t, resp.Close)
+	}
+}
+
+func TestNoBodyKeepAlive(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/empty" {
+			w.WriteStatusLine(response.NoContent)
+			h := headers.NewHeaders()
+			h.Set("X-Empty", "1")
+			w.WriteHeaders(h)
+			return
+		}
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: 204 and HEAD responses don't close the connection, the
+	// pipelined request after them is answered
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /empty HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"HEAD /head HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /last HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	for _, tc := range []struct{ method, body string }{{"GET", ""}, {"HEAD", ""}, {"GET", "/last"}} {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: tc.method})
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, tc.body, string(body))
+		assert.False(t, resp.Close)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate/key pair from files and picks up new
+// files without a restart, either on Reload or when the files change
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the loaded files
+}
+
+// NewCertReloader loads the pair from certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("error: TLS needs both a certificate and a key file")
+	}
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the pair from its files again, the current certificate is
+// kept if the new one can't be loaded
+func (r *CertReloader) Reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error: couldn't load certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files changed since they were loaded. It fits tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	cert, loaded := r.cert, r.modTime
+	r.mu.RUnlock()
+
+	if modTime, err := r.filesModTime(); err == nil && modTime.After(loaded) {
+		// the files may be half written, keep serving the old pair until
+		// both of them load
+		if err := r.Reload(); err == nil {
+			r.mu.RLock()
+			cert = r.cert
+			r.mu.RUnlock()
+		}
+	}
+	return cert, nil
+}
+
+// filesModTime returns the latest modification time of the cert and key files
+func (r *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error: couldn't stat certificate file: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// initTLS builds the TLS config from Config.TLSConfig and the cert/key files,
+// it returns nil for a plaintext server
+func (s *Server) initTLS() (*tls.Config, error) {
+	s.tlsOnce.Do(func() {
+		// a single file is a misconfiguration NewCertReloader reports,
+		// not a plaintext server
+		if s.cfg.TLSConfig == nil && s.cfg.CertFile == "" && s.cfg.KeyFile == "" {
+			return
+		}
+
+		cfg := &tls.Config{}
+		if s.cfg.TLSConfig != nil {
+			cfg = s.cfg.TLSConfig.Clone()
+		}
+		if s.cfg.CertFile != "" || s.cfg.KeyFile != "" {
+			certs, err := NewCertReloader(s.cfg.CertFile, s.cfg.KeyFile)
+			if err != nil {
+				s.tlsErr = err
+				return
+			}
+			s.certs = certs
+			cfg.GetCertificate = certs.GetCertificate
+		}
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{"http/1.1"}
+		}
+		s.tlsConfig = cfg
+	})
+	return s.tlsConfig, s.tlsErr
+}
+
+// ReloadCertificates reloads Config.CertFile and Config.KeyFile, e.g. on SIGHUP
+func (s *Server) ReloadCertificates() error {
+	if _, err := s.initTLS(); err != nil {
+		return err
+	}
+	if s.certs == nil {
+		return fmt.Errorf("error: server has no certificate files")
+	}
+	return s.certs.Reload()
+}
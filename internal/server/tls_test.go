@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSigned returns a PEM certificate and key for localhost with the given serial
+func selfSigned(t *testing.T, serial int64) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// tlsHandler echoes the negotiated TLS state of the request
+func tlsHandler(w *response.Writer, req *request.Request) {
+	body := []byte("plaintext")
+	if req.TLS != nil {
+		body = fmt.Appendf(nil, "%s %s", tls.VersionName(req.TLS.Version), req.TLS.ServerName)
+	}
+	w.WriteBody(body)
+}
+
+// getTLS sends a GET over a new TLS connection and returns the body and
+// the serial of the server certificate
+func getTLS(t *testing.T, addr string) (string, int64) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestTLSConfig(t *testing.T) {
+	certPEM, keyPEM := selfSigned(t, 1)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	cfg := DefaultConfig()
+	cfg.Handler = tlsHandler
+	cfg.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+	s := New(cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+
+	// Test: TLS state is exposed on the request
+	body, serial := getTLS(t, l.Addr().String())
+	assert.Equal(t, "TLS 1.3 localhost", body)
+	assert.Equal(t, int64(1), serial)
+
+	// Test: Plaintext clients can't talk to the server
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Error(t, err)
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writePair := func(serial int64, modTime time.Time) {
+		certPEM, keyPEM := selfSigned(t, serial)
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	start := time.Now().Add(-time.Minute)
+	writePair(1, start)
+
+	cfg := DefaultConfig()
+	cfg.Handler = tlsHandler
+	cfg.CertFile = certFile
+	cfg.KeyFile = keyFile
+	s := New(cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+	addr := l.Addr().String()
+
+	// Test: Certificate files are served
+	_, serial := getTLS(t, addr)
+	assert.Equal(t, int64(1), serial)
+
+	// Test: Changed files are picked up by the next handshake
+	writePair(2, start.Add(time.Second))
+	_, serial = getTLS(t, addr)
+	assert.Equal(t, int64(2), serial)
+
+	// Test: Explicit reload
+	writePair(3, start.Add(time.Second))
+	require.NoError(t, s.ReloadCertificates())
+	_, serial = getTLS(t, addr)
+	assert.Equal(t, int64(3), serial)
+
+	// Test: Broken files keep the current certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	require.Error(t, s.ReloadCertificates())
+	_, serial = getTLS(t, addr)
+	assert.Equal(t, int64(3), serial)
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	// Test: Missing certificate files
+	cfg := DefaultConfig()
+	cfg.Handler = tlsHandler
+	cfg.CertFile = "/does/not/exist.pem"
+	cfg.KeyFile = "/does/not/exist.key"
+	s := New(cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.Error(t, s.Serve(l))
+
+	// Test: A key without a certificate isn't served as plaintext, and
+	// the other way around
+	for _, files := range [][2]string{{"", "/some/key.pem"}, {"/some/cert.pem", ""}} {
+		cfg = DefaultConfig()
+		cfg.Handler = tlsHandler
+		cfg.CertFile, cfg.KeyFile = files[0], files[1]
+		s = New(cfg)
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		err = s.Serve(l)
+		assert.ErrorContains(t, err, "both a certificate and a key file")
+	}
+}
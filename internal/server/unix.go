@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks a Config.Addr as the path of a Unix domain socket
+const unixPrefix = "unix:"
+
+// unixSocketPath returns the socket path of a "unix:" address
+func unixSocketPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, unixPrefix)
+}
+
+// listenUnix listens on the Unix socket at path, replacing a stale socket
+// file left by a server that didn't shut down cleanly. The socket file gets
+// mode (if not zero) and is removed when the listener is closed
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listen, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	listen.(*net.UnixListener).SetUnlinkOnClose(true)
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			listen.Close()
+			return nil, err
+		}
+	}
+	return listen, nil
+}
+
+// removeStaleSocket removes the socket file at path if nothing accepts on
+// it anymore. Other files, and sockets still in use, are left alone so
+// Listen fails on them
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("error: %v exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// remoteAddr returns the peer address of conn. Unix socket peers are
+// usually unnamed, they still get an address of the listener's network
+func remoteAddr(conn net.Conn) net.Addr {
+	addr := conn.RemoteAddr()
+	if unixAddr, ok := addr.(*net.UnixAddr); addr == nil || ok && unixAddr == nil {
+		return &net.UnixAddr{Net: conn.LocalAddr().Network()}
+	}
+	return addr
+}
@@ -0,0 +1,104 @@
+package vhost
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/h0dy/tcp-to-http/internal/server"
+)
+
+type wildcard struct {
+	suffix  string // ".example.com" for "*.example.com"
+	handler server.Handler
+}
+
+// Dispatcher hands requests to a handler by the host they are for, see
+// request.Request.Host. Patterns are hostnames like "example.com", or
+// "*.example.com" matching every subdomain (at any depth) but not
+// example.com itself. An exact hostname wins over wildcards, and a longer
+// wildcard wins over a shorter one
+type Dispatcher struct {
+	hosts     map[string]server.Handler
+	wildcards []wildcard // longest suffix first
+
+	// Default handles requests for hosts matching no pattern, it defaults
+	// to a 421 Misdirected Request
+	Default server.Handler
+}
+
+// New returns an empty Dispatcher
+func New() *Dispatcher {
+	return &Dispatcher{
+		hosts:   map[string]server.Handler{},
+		Default: misdirected,
+	}
+}
+
+// Handle registers handler for the hosts matching pattern, it panics on a
+// malformed or already registered pattern like the rest of the setup code
+// would
+func (d *Dispatcher) Handle(pattern string, handler server.Handler) {
+	host := strings.TrimSuffix(strings.ToLower(pattern), ".")
+	suffix, isWildcard := strings.CutPrefix(host, "*")
+	switch {
+	case host == "" || suffix == "" || suffix == ".":
+		panic(&PatternError{Pattern: pattern, Reason: "empty host"})
+	case strings.ContainsAny(suffix, "*/:"):
+		panic(&PatternError{Pattern: pattern, Reason: "must be a hostname, optionally starting with *."})
+	case isWildcard && !strings.HasPrefix(suffix, "."):
+		panic(&PatternError{Pattern: pattern, Reason: "wildcard must be a whole label, e.g. *.example.com"})
+	}
+
+	if !isWildcard {
+		if _, ok := d.hosts[host]; ok {
+			panic(&PatternError{Pattern: pattern, Reason: "already registered"})
+		}
+		d.hosts[host] = handler
+		return
+	}
+	if slices.ContainsFunc(d.wildcards, func(w wildcard) bool { return w.suffix == suffix }) {
+		panic(&PatternError{Pattern: pattern, Reason: "already registered"})
+	}
+	d.wildcards = append(d.wildcards, wildcard{suffix: suffix, handler: handler})
+	slices.SortStableFunc(d.wildcards, func(a, b wildcard) int {
+		return len(b.suffix) - len(a.suffix)
+	})
+}
+
+// Handler returns the server.Handler dispatching to the registered hosts
+func (d *Dispatcher) Handler() server.Handler {
+	return d.serve
+}
+
+func (d *Dispatcher) serve(w *response.Writer, req *request.Request) {
+	if handler, ok := d.hosts[req.Host]; ok {
+		handler(w, req)
+		return
+	}
+	for _, wc := range d.wildcards {
+		if len(req.Host) > len(wc.suffix) && strings.HasSuffix(req.Host, wc.suffix) {
+			wc.handler(w, req)
+			return
+		}
+	}
+	d.Default(w, req)
+}
+
+func misdirected(w *response.Writer, _ *request.Request) {
+	w.WriteStatusLine(response.MisdirectedRequest)
+	body := []byte("421 Misdirected Request\n")
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// PatternError describes a malformed host pattern
+type PatternError struct {
+	Pattern string
+	Reason  string
+}
+
+func (e *PatternError) Error() string {
+	return "error: invalid host pattern " + e.Pattern + ": " + e.Reason
+}
@@ -0,0 +1,89 @@
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/h0dy/tcp-to-http/internal/request"
+	"github.com/h0dy/tcp-to-http/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request for host through d and parses the response it writes
+func serve(t *testing.T, d *Dispatcher, host string) (*http.Response, string) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	d.Handler()(response.NewWriter(buf), req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+// site writes its name as the body
+func site(name string) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, _ *request.Request) {
+		w.WriteBody([]byte(name))
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	d := New()
+	d.Handle("example.com", site("main"))
+	d.Handle("*.example.com", site("any-sub"))
+	d.Handle("*.api.example.com", site("api-sub"))
+	d.Handle("Docs.Example.com", site("docs"))
+
+	// Test: Exact hostname, whatever the case and port
+	_, body := serve(t, d, "example.com")
+	assert.Equal(t, "main", body)
+	_, body = serve(t, d, "EXAMPLE.com:8080")
+	assert.Equal(t, "main", body)
+
+	// Test: Exact hostname wins over a wildcard
+	_, body = serve(t, d, "docs.example.com")
+	assert.Equal(t, "docs", body)
+
+	// Test: Wildcards match subdomains at any depth
+	_, body = serve(t, d, "blog.example.com")
+	assert.Equal(t, "any-sub", body)
+	_, body = serve(t, d, "a.b.example.com")
+	assert.Equal(t, "any-sub", body)
+
+	// Test: Longer wildcard wins
+	_, body = serve(t, d, "v1.api.example.com")
+	assert.Equal(t, "api-sub", body)
+
+	// Test: Unknown host gets a 421
+	resp, _ := serve(t, d, "example.org")
+	assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	resp, _ = serve(t, d, "notexample.com")
+	assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+
+	// Test: Custom Default handler
+	d.Default = site("fallback")
+	_, body = serve(t, d, "example.org")
+	assert.Equal(t, "fallback", body)
+}
+
+func TestHandlePattern(t *testing.T) {
+	// Test: Malformed and duplicate patterns panic
+	for _, pattern := range []string{"", "*", "*.", "*example.com", "a.*.com", "example.com:80", "example.com/path"} {
+		assert.Panics(t, func() { New().Handle(pattern, site("x")) }, pattern)
+	}
+	d := New()
+	d.Handle("example.com", site("a"))
+	assert.Panics(t, func() { d.Handle("EXAMPLE.com", site("b")) })
+	d.Handle("*.example.com", site("a"))
+	assert.Panics(t, func() { d.Handle("*.example.com", site("b")) })
+}